@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/csrwng/bindmountproxy/pkg/bindmountproxy"
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+const explainArguments = `[CREATE_BODY]
+
+CREATE_BODY is a file with the JSON body of a container create request, or -
+to read it from standard input. Use --image instead to explain a request that
+only specifies an image.`
+
+func runExplain(args []string) error {
+	flags := newFlagSet("explain", explainArguments)
+	config := flags.String("config", os.Getenv("PROXY_CONFIG"), "Configuration file (defaults to $PROXY_CONFIG)")
+	openshiftPath := flags.String("openshift", "", "Path to the openshift binary, used when no configuration is specified")
+	image := flags.String("image", "", "Image of the container, instead of a create request body")
+	name := flags.String("name", "", "Name of the container, as given to docker create --name")
+	offline := flags.Bool("offline", false, "Match rules without inspecting images in the Docker daemon")
+	apiVersion := flags.String("api-version", "", "Docker API version of the request (defaults to the version of the daemon)")
+	docker := addDockerFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() > 1 || (flags.NArg() == 1) == (len(*image) > 0) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var cfg *bindmountproxy.BindMountProxyConfig
+	switch {
+	case len(*config) > 0:
+		var err error
+		if cfg, err = bindmountproxy.LoadConfigFile(*config); err != nil {
+			return err
+		}
+	case len(*openshiftPath) > 0:
+		cfg = defaultOpenShiftConfig(*openshiftPath)
+	default:
+		return fmt.Errorf("specify a configuration or a path to the 'openshift' binary")
+	}
+	rules, err := bindmountproxy.NewRuleSet(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	var backend *dockerproxy.Backend
+	if !*offline {
+		if backend, err = newBackend(cfg, docker.override); err != nil {
+			return fmt.Errorf("invalid docker host: %v", err)
+		}
+	}
+
+	var version dockerproxy.APIVersion
+	switch {
+	case len(*apiVersion) > 0:
+		if version, err = dockerproxy.ParseAPIVersion(*apiVersion); err != nil {
+			return err
+		}
+	case backend != nil:
+		if version, err = backend.APIVersion(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: matching without an API version: %v\n", err)
+		}
+	}
+
+	var body []byte
+	switch {
+	case len(*image) > 0:
+		body, err = json.Marshal(map[string]string{"Image": *image})
+	case flags.Arg(0) == "-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	default:
+		body, err = ioutil.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	explanation, explainErr := rules.Explain(body, *name, version, backend)
+	for _, result := range explanation.Rules {
+		rule := fmt.Sprintf("bindMounts[%d]", result.Index)
+		if len(result.Name) > 0 {
+			rule += fmt.Sprintf(" (%s)", result.Name)
+		}
+		if len(result.Source) > 0 {
+			rule = result.Source + ": " + rule
+		}
+		switch {
+		case result.Disabled:
+			fmt.Printf("%s: disabled\n", rule)
+		case result.Matched:
+			fmt.Printf("%s: matched\n", rule)
+		default:
+			fmt.Printf("%s: not matched, %s\n", rule, result.Reason)
+		}
+	}
+	if explainErr != nil {
+		return fmt.Errorf("the request would be rejected: %v", explainErr)
+	}
+	fmt.Println()
+	fmt.Print(diffLines("original", "rewritten", indentJSON(body), indentJSON(explanation.Body)))
+	return nil
+}
+
+// indentJSON returns the lines of a JSON document formatted for display
+func indentJSON(data []byte) []string {
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, data, "", "  "); err != nil {
+		buf = bytes.NewBuffer(data)
+	}
+	return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+}
+
+// diffLines returns a diff of two lists of lines, with the lines only in a
+// prefixed by - and the lines only in b prefixed by +
+func diffLines(nameA, nameB string, a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", nameA, nameB)
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(out, " %s\n", a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(out, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(out, "+%s\n", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
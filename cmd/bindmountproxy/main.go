@@ -1,68 +1,181 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"runtime"
+	"strings"
 
 	"github.com/csrwng/bindmountproxy/pkg/bindmountproxy"
 )
 
+// version is set when building a release with
+// -ldflags "-X main.version=VERSION"
+var version = "unknown"
+
+// command is a subcommand of the proxy. run receives the arguments that
+// follow the command name.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Run the proxy", runServe},
+		{"validate", "Check a configuration file for errors", runValidate},
+		{"explain", "Show how the proxy rewrites a container create request", runExplain},
+		{"dump-default", "Print the built-in OpenShift configuration", runDumpDefault},
+		{"version", "Print the version of the proxy", runVersion},
+	}
+}
+
 func main() {
-	var cfg *bindmountproxy.BindMountProxyConfig
-	flag.Parse()
-	args := os.Args
-	if len(args) < 2 {
-		fmt.Printf(usage())
+	// glog only logs without complaining once the default flag set has been
+	// parsed. Its flags are added to the flag set of every command, and may
+	// also be given before the command.
+	globals, args := splitGlobalFlags(os.Args[1:])
+	flag.CommandLine.Parse(globals)
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage())
+		os.Exit(2)
+	}
+	run := runServe
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage())
+		return
+	default:
+		// The proxy was originally started with only a listen address and the
+		// path to the openshift binary, which still runs serve
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				run, args = cmd.run, args[1:]
+				break
+			}
+		}
+	}
+	if err := run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
-	listenSpec := args[1]
-	if len(os.Getenv("PROXY_CONFIG")) > 0 {
-		configData, err := ioutil.ReadFile(os.Getenv("PROXY_CONFIG"))
-		if err != nil {
-			fmt.Printf("error: cannot read configuration: %v", err)
-			os.Exit(1)
+}
+
+// splitGlobalFlags splits the leading flags of the default flag set, such as
+// -v=2, from the command and its arguments
+func splitGlobalFlags(args []string) ([]string, []string) {
+	i := 0
+	for i < len(args) {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
 		}
-		cfg = &bindmountproxy.BindMountProxyConfig{}
-		err = json.Unmarshal(configData, cfg)
-		if err != nil {
-			fmt.Printf("error: cannot unmarshal configuration: %v", err)
-			os.Exit(1)
+		f := flag.CommandLine.Lookup(name)
+		if f == nil {
+			// Flags of the serve command given without a command
+			break
 		}
-	} else {
-		if len(args) < 3 {
-			fmt.Printf("specify a path to the 'openshift' binary")
-			os.Exit(1)
+		i++
+		if boolFlag, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); !hasValue && !(ok && boolFlag.IsBoolFlag()) && i < len(args) {
+			i++
 		}
-		binariesPath := os.Args[2]
-		cfg = defaultOpenShiftConfig(binariesPath)
 	}
-	fmt.Printf("Starting bindmount proxy with config: %#v\n", cfg)
-	err := http.ListenAndServe(listenSpec, bindmountproxy.New(cfg))
+	return args[:i], args[i:]
+}
+
+// newFlagSet returns the flag set of a command, including the glog flags
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  %s %s [OPTIONS] %s\n\nOptions:\n", os.Args[0], name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func runValidate(args []string) error {
+	flags := newFlagSet("validate", "CONFIG")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	cfg, err := bindmountproxy.LoadConfigFile(path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	rules, err := bindmountproxy.NewRuleSet(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", path, err)
 	}
+	if _, err = newBackend(cfg, nil); err != nil {
+		return fmt.Errorf("invalid configuration %s: dockerHost: %v", path, err)
+	}
+	fmt.Printf("%s is valid: %d active rule(s), %d disabled, from %s\n", path, rules.Len(), len(cfg.BindMounts)-rules.Len(), strings.Join(cfg.Sources, ", "))
+	return nil
+}
+
+func runDumpDefault(args []string) error {
+	flags := newFlagSet("dump-default", "")
+	openshiftPath := flags.String("openshift", "", "Path to the openshift binary to mount into OpenShift containers (required)")
+	format := flags.String("format", bindmountproxy.FormatJSON, "Format of the configuration: json, yaml or toml")
+	flags.Parse(args)
+	if len(*openshiftPath) == 0 || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	data, err := bindmountproxy.MarshalConfig(defaultOpenShiftConfig(*openshiftPath), *format)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runVersion(args []string) error {
+	flags := newFlagSet("version", "")
+	flags.Parse(args)
+	fmt.Printf("bindmountproxy %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
 }
 
 func defaultOpenShiftConfig(path string) *bindmountproxy.BindMountProxyConfig {
-	imagePatterns := []string{
-		"(openshift/origin$)|(openshift/origin:.*)",
-		"openshift/origin-deployer.*",
-		"openshift/origin-recycler.*",
-		"openshift/origin-docker-builder.*",
-		"openshift/origin-sti-builder.*",
-		"openshift/origin-f5-router.*",
-		"openshift/node.*",
-	}
-
-	cfg := &bindmountproxy.BindMountProxyConfig{}
-	for _, pattern := range imagePatterns {
+	repositories := []string{
+		"openshift/origin",
+		"openshift/origin-deployer",
+		"openshift/origin-recycler",
+		"openshift/origin-docker-builder",
+		"openshift/origin-sti-builder",
+		"openshift/origin-f5-router",
+		"openshift/node",
+	}
+
+	cfg := &bindmountproxy.BindMountProxyConfig{
+		APIVersion: bindmountproxy.ConfigAPIVersion,
+		Kind:       bindmountproxy.ConfigKind,
+	}
+	for _, repository := range repositories {
 		cfg.BindMounts = append(cfg.BindMounts, bindmountproxy.ImageBindMountConfig{
-			ImagePattern: pattern,
+			Name: repository,
+			Image: &bindmountproxy.ImageMatchConfig{
+				Repository: repository,
+			},
 			Mounts: []bindmountproxy.BindMountConfig{
 				{
 					Source:      path,
@@ -77,18 +190,20 @@ func defaultOpenShiftConfig(path string) *bindmountproxy.BindMountProxyConfig {
 
 const usageString = `
 Usage:
-%[1]s LISTEN_SPEC OPENSHIFT_PATH
+%[1]s COMMAND [OPTIONS] [ARGS]
 
-where LISTEN_SPEC is either a port (ie. :1080) 
-or an IP and port (ie. 127.0.0.1:1080) 
-
-and OPENSHIFT_PATH is the path to the openshift binary
-(ie. /data/src/github.com/openshift/origin/_output/local/bin/linux/adm64/openshift )
+Commands:
+%[2]s
+Run '%[1]s COMMAND -h' for the options of a command.
 
 Example:
-%[1]s ":2375" $(which openshift)
+%[1]s serve --listen :2375 --openshift $(which openshift)
 `
 
 func usage() string {
-	return fmt.Sprintf(usageString, os.Args[0])
+	descriptions := ""
+	for _, cmd := range commands {
+		descriptions += fmt.Sprintf("  %-14s %s\n", cmd.name, cmd.description)
+	}
+	return fmt.Sprintf(usageString, os.Args[0], descriptions)
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"github.com/csrwng/bindmountproxy/pkg/bindmountproxy"
+	"github.com/csrwng/bindmountproxy/pkg/filewatch"
+)
+
+// configReloader reloads the proxy configuration whenever one of the files it
+// was loaded from changes or the proxy receives SIGHUP. If the new
+// configuration is invalid, the proxy keeps using the current one.
+type configReloader struct {
+	path    string
+	proxy   *bindmountproxy.Proxy
+	reloads chan struct{}
+	// watcher watches the configuration sources, or is nil if the
+	// configuration is only reloaded on SIGHUP
+	watcher *filewatch.Watcher
+}
+
+func watchConfig(path string, proxy *bindmountproxy.Proxy, watch bool) error {
+	r := &configReloader{
+		path:    path,
+		proxy:   proxy,
+		reloads: make(chan struct{}, 1),
+	}
+	if watch {
+		var err error
+		if r.watcher, err = filewatch.New(r.requestReload); err != nil {
+			return fmt.Errorf("cannot watch configuration: %v", err)
+		}
+		if err = r.watcher.Set(proxy.Config().Sources); err != nil {
+			return fmt.Errorf("cannot watch configuration: %v", err)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.requestReload()
+		}
+	}()
+	go func() {
+		for range r.reloads {
+			r.reload()
+		}
+	}()
+	return nil
+}
+
+func (r *configReloader) requestReload() {
+	select {
+	case r.reloads <- struct{}{}:
+	default:
+	}
+}
+
+func (r *configReloader) reload() {
+	cfg, err := bindmountproxy.LoadConfigFile(r.path)
+	if err != nil {
+		glog.Errorf("Not reloading configuration: %v", err)
+		return
+	}
+	// Files included by the new configuration are watched, and files it no
+	// longer includes are not
+	if r.watcher != nil {
+		if err = r.watcher.Set(cfg.Sources); err != nil {
+			glog.Errorf("Cannot watch configuration sources: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(cfg.DockerHost, r.proxy.Config().DockerHost) {
+		glog.Warningf("Docker host settings changed in %s, restart the proxy to apply them", r.path)
+	}
+	if err = r.proxy.Reload(cfg); err != nil {
+		glog.Errorf("Not reloading invalid configuration from %s: %v", r.path, err)
+		return
+	}
+	glog.Infof("Reloaded configuration from %s", r.path)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/csrwng/bindmountproxy/pkg/bindmountproxy"
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+const serveArguments = `[LISTEN_SPEC [OPENSHIFT_PATH]]
+
+LISTEN_SPEC is either a port (ie. :1080), an IP and port
+(ie. 127.0.0.1:1080 or tcp://127.0.0.1:1080) or a unix socket
+(ie. unix:///var/run/bindmountproxy.sock). It may also be given with --listen.
+
+OPENSHIFT_PATH is the path to the openshift binary
+(ie. /data/src/github.com/openshift/origin/_output/local/bin/linux/amd64/openshift).
+It may also be given with --openshift, and is used to build the default
+configuration when no --config is specified.
+
+The Docker daemon defaults to unix:///var/run/docker.sock and may also be a
+tcp://host:port address. Use --docker-tls-verify, --docker-tls-cacert,
+--docker-tls-cert and --docker-tls-key to connect to a daemon over TLS.
+
+Use --tls-cert and --tls-key to serve the proxy over TLS, and --tls-cacert
+to only accept clients with a certificate signed by the given CA.
+
+The admin API is best served on a unix socket. On a tcp address it requires
+--admin-tls-cert, --admin-tls-key and --admin-tls-cacert, so that only
+clients with a certificate signed by the given CA can change the rules.`
+
+type serveOptions struct {
+	listen        string
+	config        string
+	openshiftPath string
+	logLevel      string
+	watchConfig   bool
+
+	docker *dockerFlags
+
+	socketMode  string
+	socketOwner string
+	tlsCert     string
+	tlsKey      string
+	tlsCACert   string
+
+	adminListen    string
+	adminPersist   bool
+	adminTLSCert   string
+	adminTLSKey    string
+	adminTLSCACert string
+
+	metricsListen string
+	auditLog      string
+}
+
+func runServe(args []string) error {
+	o := &serveOptions{}
+	flags := newFlagSet("serve", serveArguments)
+	flags.StringVar(&o.listen, "listen", "", "Address or unix socket the proxy listens on")
+	flags.StringVar(&o.config, "config", os.Getenv("PROXY_CONFIG"), "Configuration file (defaults to $PROXY_CONFIG)")
+	flags.StringVar(&o.openshiftPath, "openshift", "", "Path to the openshift binary, used when no configuration is specified")
+	flags.StringVar(&o.logLevel, "log-level", "", "Log verbosity, the same as -v")
+	flags.BoolVar(&o.watchConfig, "watch-config", true, "Reload the configuration when it changes on disk (it is always reloaded on SIGHUP)")
+
+	o.docker = addDockerFlags(flags)
+
+	flags.StringVar(&o.socketMode, "socket-mode", "0660", "Permissions of the proxy socket when listening on a unix socket")
+	flags.StringVar(&o.socketOwner, "socket-owner", "", "Owner (user[:group]) of the proxy socket when listening on a unix socket")
+	flags.StringVar(&o.tlsCert, "tls-cert", "", "Server certificate used to serve the proxy over TLS")
+	flags.StringVar(&o.tlsKey, "tls-key", "", "Server key used to serve the proxy over TLS")
+	flags.StringVar(&o.tlsCACert, "tls-cacert", "", "Require clients to present a certificate signed by this CA")
+	flags.StringVar(&o.adminListen, "admin-listen", "", "Address or unix socket to serve the admin API on (disabled if empty)")
+	flags.BoolVar(&o.adminPersist, "admin-persist", false, "Write changes made through the admin API to the configuration file")
+	flags.StringVar(&o.adminTLSCert, "admin-tls-cert", "", "Server certificate used to serve the admin API over TLS (required on tcp addresses)")
+	flags.StringVar(&o.adminTLSKey, "admin-tls-key", "", "Server key used to serve the admin API over TLS (required on tcp addresses)")
+	flags.StringVar(&o.adminTLSCACert, "admin-tls-cacert", "", "Require admin API clients to present a certificate signed by this CA (required on tcp addresses)")
+	flags.StringVar(&o.metricsListen, "metrics-listen", "", "Address or unix socket to serve Prometheus metrics on at /metrics (disabled if empty)")
+	flags.StringVar(&o.auditLog, "audit-log", "", "File to append a JSON record of every container create to, or - for standard output")
+	flags.Parse(args)
+
+	positional := flags.Args()
+	if len(positional) > 0 && len(o.listen) == 0 {
+		o.listen, positional = positional[0], positional[1:]
+	}
+	if len(positional) > 0 && len(o.openshiftPath) == 0 {
+		o.openshiftPath, positional = positional[0], positional[1:]
+	}
+	if len(o.listen) == 0 || len(positional) > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if len(o.logLevel) > 0 {
+		if err := flags.Set("v", o.logLevel); err != nil {
+			return fmt.Errorf("invalid log level %q: %v", o.logLevel, err)
+		}
+	}
+	return o.run()
+}
+
+func (o *serveOptions) run() error {
+	var cfg *bindmountproxy.BindMountProxyConfig
+	if len(o.config) > 0 {
+		var err error
+		cfg, err = bindmountproxy.LoadConfigFile(o.config)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(o.openshiftPath) == 0 {
+			return fmt.Errorf("specify a configuration or a path to the 'openshift' binary")
+		}
+		cfg = defaultOpenShiftConfig(o.openshiftPath)
+	}
+	backend, err := newBackend(cfg, o.docker.override)
+	if err != nil {
+		return fmt.Errorf("invalid docker host: %v", err)
+	}
+	proxy, err := bindmountproxy.New(cfg, backend)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if len(o.auditLog) > 0 {
+		audit := os.Stdout
+		if o.auditLog != "-" {
+			if audit, err = os.OpenFile(o.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+				return fmt.Errorf("cannot open audit log: %v", err)
+			}
+		}
+		proxy.SetAuditLog(audit)
+	}
+	var admin http.Handler
+	if len(o.adminListen) > 0 {
+		if admin, err = o.adminHandler(proxy); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Starting bindmount proxy for %s with config: %#v\n", backend, cfg)
+	mode, err := strconv.ParseUint(o.socketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", o.socketMode, err)
+	}
+	listener, err := dockerproxy.Listen(dockerproxy.ListenConfig{
+		Spec:        o.listen,
+		SocketMode:  os.FileMode(mode),
+		SocketOwner: o.socketOwner,
+		TLSCert:     o.tlsCert,
+		TLSKey:      o.tlsKey,
+		TLSCACert:   o.tlsCACert,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", o.listen, err)
+	}
+	if len(o.config) > 0 {
+		if err = watchConfig(o.config, proxy, o.watchConfig); err != nil {
+			return err
+		}
+	}
+	errs := make(chan error, 3)
+	if admin != nil {
+		// The admin API can add host mounts to every container, so it is only
+		// served on tcp addresses to clients with a trusted certificate
+		err = serveAPI("admin API", dockerproxy.ListenConfig{
+			Spec:              o.adminListen,
+			SocketMode:        0600,
+			TLSCert:           o.adminTLSCert,
+			TLSKey:            o.adminTLSKey,
+			TLSCACert:         o.adminTLSCACert,
+			RequireClientCert: true,
+		}, admin, errs)
+		if err != nil {
+			return err
+		}
+	}
+	if len(o.metricsListen) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proxy.Metrics())
+		if err = serveAPI("metrics", dockerproxy.ListenConfig{Spec: o.metricsListen, SocketMode: 0600}, mux, errs); err != nil {
+			return err
+		}
+	}
+	go func() {
+		errs <- http.Serve(listener, proxy)
+	}()
+	return <-errs
+}
+
+// serveAPI serves an API of the proxy other than the Docker API on its own
+// listener, reporting to errs when it stops serving
+func serveAPI(name string, cfg dockerproxy.ListenConfig, handler http.Handler, errs chan<- error) error {
+	listener, err := dockerproxy.Listen(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: cannot listen on %s: %v", name, cfg.Spec, err)
+	}
+	go func() {
+		errs <- fmt.Errorf("%s: %v", name, http.Serve(listener, handler))
+	}()
+	return nil
+}
+
+func (o *serveOptions) adminHandler(proxy *bindmountproxy.Proxy) (http.Handler, error) {
+	opts := bindmountproxy.AdminOptions{}
+	if o.adminPersist {
+		if len(o.config) == 0 {
+			return nil, fmt.Errorf("--admin-persist requires a configuration file")
+		}
+		// Changes are written as a single file, which would duplicate the
+		// rules of included files
+		if len(proxy.Config().Sources) > 1 {
+			return nil, fmt.Errorf("--admin-persist cannot be used with a configuration that includes other files")
+		}
+		opts.PersistPath = o.config
+	}
+	return bindmountproxy.NewAdminHandler(proxy, opts), nil
+}
+
+// dockerFlags are the command line options that select the Docker daemon.
+// They override the dockerHost settings of the configuration.
+type dockerFlags struct {
+	flags     *flag.FlagSet
+	host      string
+	tlsVerify bool
+	tlsCACert string
+	tlsCert   string
+	tlsKey    string
+}
+
+func addDockerFlags(flags *flag.FlagSet) *dockerFlags {
+	d := &dockerFlags{flags: flags}
+	flags.StringVar(&d.host, "docker-host", "", "Docker daemon to proxy to (unix:///path/to/docker.sock or tcp://host:port)")
+	flags.BoolVar(&d.tlsVerify, "docker-tls-verify", false, "Verify the Docker daemon's TLS certificate")
+	flags.StringVar(&d.tlsCACert, "docker-tls-cacert", "", "CA certificate used to verify the Docker daemon")
+	flags.StringVar(&d.tlsCert, "docker-tls-cert", "", "Client certificate used to authenticate with the Docker daemon")
+	flags.StringVar(&d.tlsKey, "docker-tls-key", "", "Client key used to authenticate with the Docker daemon")
+	return d
+}
+
+// override applies the docker flags specified on the command line to the
+// backend settings
+func (d *dockerFlags) override(backendCfg *dockerproxy.BackendConfig) {
+	d.flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "docker-host":
+			backendCfg.Host = d.host
+		case "docker-tls-verify":
+			backendCfg.TLSVerify = d.tlsVerify
+		case "docker-tls-cacert":
+			backendCfg.TLSCACert = d.tlsCACert
+		case "docker-tls-cert":
+			backendCfg.TLSCert = d.tlsCert
+		case "docker-tls-key":
+			backendCfg.TLSKey = d.tlsKey
+		}
+	})
+}
+
+// newBackend returns the Docker backend of the proxy configuration, with
+// the given overrides applied if they are not nil
+func newBackend(cfg *bindmountproxy.BindMountProxyConfig, overrides func(*dockerproxy.BackendConfig)) (*dockerproxy.Backend, error) {
+	backendCfg := dockerproxy.BackendConfig{}
+	if cfg.DockerHost != nil {
+		backendCfg = dockerproxy.BackendConfig{
+			Host:      cfg.DockerHost.Host,
+			TLSVerify: cfg.DockerHost.TLSVerify,
+			TLSCACert: cfg.DockerHost.TLSCACert,
+			TLSCert:   cfg.DockerHost.TLSCert,
+			TLSKey:    cfg.DockerHost.TLSKey,
+		}
+	}
+	if overrides != nil {
+		overrides(&backendCfg)
+	}
+	return dockerproxy.NewBackend(backendCfg)
+}
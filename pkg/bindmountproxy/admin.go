@@ -0,0 +1,233 @@
+package bindmountproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// AdminOptions configures the admin API of a proxy
+type AdminOptions struct {
+	// PersistPath is the configuration file that changes made through the
+	// API are written to. If it is empty, changes are only kept in memory
+	// until the configuration is reloaded.
+	PersistPath string
+}
+
+// adminHandler serves the admin API, which inspects and changes the rules of
+// a proxy while it is running:
+//
+//	GET  /rules                 returns the rules of the configuration
+//	PUT  /rules                 replaces the rules with those in the body
+//	POST /rules/{name}/disable  disables the rule with the given name
+//	GET  /status                returns the state of the proxy
+//	GET  /metrics               returns the metrics of the proxy
+type adminHandler struct {
+	proxy       *Proxy
+	persistPath string
+	// lock serializes changes, so that concurrent requests do not overwrite
+	// each other's rules
+	lock sync.Mutex
+}
+
+// NewAdminHandler returns the handler of the admin API of the proxy. It is
+// meant to be served on its own listener, separate from the Docker API, since
+// anyone who can reach it can change the mounts of new containers.
+func NewAdminHandler(p *Proxy, opts AdminOptions) http.Handler {
+	return &adminHandler{proxy: p, persistPath: opts.PersistPath}
+}
+
+// adminStatus is the response to GET /status
+type adminStatus struct {
+	DockerHost    string    `json:"dockerHost"`
+	Rules         int       `json:"rules"`
+	DisabledRules int       `json:"disabledRules"`
+	Sources       []string  `json:"sources,omitempty"`
+	LoadedAt      time.Time `json:"loadedAt"`
+	PersistPath   string    `json:"persistPath,omitempty"`
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	glog.V(2).Infof("Serving admin %s %s", req.Method, req.URL.Path)
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case path == "/rules":
+		switch req.Method {
+		case "GET":
+			writeJSON(w, h.proxy.Config().BindMounts)
+		case "PUT":
+			h.putRules(w, req)
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	case strings.HasPrefix(path, "/rules/") && strings.HasSuffix(path, "/disable"):
+		// Rule names may contain slashes, such as openshift/origin
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/rules/"), "/disable")
+		if req.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		h.disableRule(w, name)
+	case path == "/status":
+		if req.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		h.status(w)
+	case path == "/metrics":
+		h.proxy.Metrics().ServeHTTP(w, req)
+	default:
+		dockerproxy.WriteError(w, dockerproxy.NotFound("page not found"), http.StatusNotFound)
+	}
+}
+
+func (h *adminHandler) putRules(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		dockerproxy.WriteError(w, dockerproxy.BadRequest("cannot read rules: %v", err), http.StatusBadRequest)
+		return
+	}
+	var rules json.RawMessage
+	if err = json.Unmarshal(body, &rules); err != nil {
+		dockerproxy.WriteError(w, dockerproxy.BadRequest("invalid rules: %v", err), http.StatusBadRequest)
+		return
+	}
+	// The rules are parsed as a configuration, so that they are checked for
+	// unknown fields like rules read from a file
+	doc, err := json.Marshal(map[string]json.RawMessage{"bindMounts": rules})
+	if err != nil {
+		dockerproxy.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	parsed, err := ParseConfig(doc, FormatJSON)
+	if err != nil {
+		dockerproxy.WriteError(w, dockerproxy.BadRequest("invalid rules: %v", err), http.StatusBadRequest)
+		return
+	}
+	cfg, err := h.update(func(cfg *BindMountProxyConfig) error {
+		cfg.BindMounts = parsed.BindMounts
+		return nil
+	})
+	if err != nil {
+		dockerproxy.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Replaced rules through the admin API, %d rule(s) configured", len(cfg.BindMounts))
+	writeJSON(w, cfg.BindMounts)
+}
+
+func (h *adminHandler) disableRule(w http.ResponseWriter, name string) {
+	var disabled ImageBindMountConfig
+	_, err := h.update(func(cfg *BindMountProxyConfig) error {
+		for i := range cfg.BindMounts {
+			if cfg.BindMounts[i].Name == name {
+				cfg.BindMounts[i].Disabled = true
+				disabled = cfg.BindMounts[i]
+				return nil
+			}
+		}
+		return dockerproxy.NotFound("no rule named %q", name)
+	})
+	if err != nil {
+		dockerproxy.WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Disabled rule %q through the admin API", name)
+	writeJSON(w, disabled)
+}
+
+func (h *adminHandler) status(w http.ResponseWriter) {
+	rules := h.proxy.Rules()
+	cfg := rules.Config()
+	writeJSON(w, &adminStatus{
+		DockerHost:    h.proxy.backend.String(),
+		Rules:         rules.Len(),
+		DisabledRules: len(cfg.BindMounts) - rules.Len(),
+		Sources:       cfg.Sources,
+		LoadedAt:      rules.Created(),
+		PersistPath:   h.persistPath,
+	})
+}
+
+// update applies modify to a copy of the active configuration and makes the
+// result the active configuration if it is valid, writing it to the persist
+// path first if there is one
+func (h *adminHandler) update(modify func(cfg *BindMountProxyConfig) error) (*BindMountProxyConfig, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	current := h.proxy.Config()
+	cfg := *current
+	cfg.BindMounts = append([]ImageBindMountConfig(nil), current.BindMounts...)
+	if err := modify(&cfg); err != nil {
+		return nil, err
+	}
+	rules, err := NewRuleSet(&cfg)
+	if err != nil {
+		return nil, dockerproxy.BadRequest("%v", err)
+	}
+	if len(h.persistPath) > 0 {
+		if err = writeConfigFile(h.persistPath, &cfg); err != nil {
+			return nil, fmt.Errorf("cannot save configuration: %v", err)
+		}
+	}
+	h.proxy.SetRules(rules)
+	return &cfg, nil
+}
+
+// writeConfigFile replaces a configuration file, in the format given by its
+// extension. The file is replaced atomically so that a proxy watching it
+// never reads a partial configuration.
+func writeConfigFile(path string, cfg *BindMountProxyConfig) error {
+	data, err := MarshalConfig(cfg, configFormat(path))
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		glog.Errorf("Error writing admin response: %v", err)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	dockerproxy.WriteError(w, &dockerproxy.RequestError{
+		StatusCode: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed, expected %s", allowed),
+	}, http.StatusMethodNotAllowed)
+}
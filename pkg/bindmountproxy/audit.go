@@ -0,0 +1,151 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxAuditResponse is the largest create response read to find the ID of the
+// created container. Create responses only hold the ID and warnings.
+const maxAuditResponse = 64 * 1024
+
+// auditRecord describes a container create request handled by the proxy and
+// what the proxy changed in it. It is written as one line of JSON.
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	ClientAddress string    `json:"clientAddress"`
+	Image         string    `json:"image"`
+	// ReplacedImage is the image the container was created from instead of
+	// Image, if a rule replaced it
+	ReplacedImage string            `json:"replacedImage,omitempty"`
+	ContainerName string            `json:"containerName,omitempty"`
+	MatchedRules  []string          `json:"matchedRules"`
+	Mounts        []BindMountConfig `json:"mounts,omitempty"`
+	Env           []string          `json:"env,omitempty"`
+	// Error is set when the proxy rejects the request instead of sending
+	// it to the daemon
+	Error string `json:"error,omitempty"`
+	// StatusCode is the status of the response returned to the client
+	StatusCode  int    `json:"statusCode"`
+	Succeeded   bool   `json:"succeeded"`
+	ContainerID string `json:"containerID,omitempty"`
+}
+
+// rewritten records the outcome of applying the rules to the request
+func (r *auditRecord) rewritten(rewrite *createRewrite, err error) {
+	r.Image = rewrite.image
+	r.ReplacedImage = rewrite.replacedImage
+	r.ContainerName = rewrite.name
+	r.MatchedRules = []string{}
+	for _, result := range rewrite.rules {
+		if result.Matched {
+			r.MatchedRules = append(r.MatchedRules, result.label)
+		}
+	}
+	r.Mounts = rewrite.mounts
+	r.Env = rewrite.env
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// responded records the response to the request
+func (r *auditRecord) responded(status int, body []byte) {
+	r.StatusCode = status
+	r.Succeeded = status == http.StatusCreated
+	if r.Succeeded {
+		created := struct {
+			ID string `json:"Id"`
+		}{}
+		if err := json.Unmarshal(body, &created); err != nil {
+			glog.V(2).Infof("Cannot read the ID of the created container: %v", err)
+		}
+		r.ContainerID = created.ID
+	}
+}
+
+type auditContextKey struct{}
+
+// auditRecordFrom returns the audit record of a request, or nil if the
+// request is not audited
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	return record
+}
+
+// auditLog writes audit records to a writer, one JSON object per line
+type auditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (l *auditLog) write(record *auditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		glog.Errorf("Cannot encode audit record: %v", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err = l.w.Write(append(data, '\n')); err != nil {
+		glog.Errorf("Cannot write audit record: %v", err)
+	}
+}
+
+// auditResponseWriter records the status and the beginning of the body of a
+// response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := maxAuditResponse - w.body.Len(); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		w.body.Write(data[:room])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveAudited serves a container create request, writing an audit record
+// once the response has been sent
+func (l *auditLog) serveAudited(handler http.Handler, w http.ResponseWriter, req *http.Request) {
+	record := &auditRecord{
+		Time:          time.Now().UTC(),
+		ClientAddress: req.RemoteAddr,
+	}
+	aw := &auditResponseWriter{ResponseWriter: w}
+	handler.ServeHTTP(aw, req.WithContext(context.WithValue(req.Context(), auditContextKey{}, record)))
+	status := aw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	record.responded(status, aw.body.Bytes())
+	l.write(record)
+}
@@ -2,22 +2,38 @@ package bindmountproxy
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"regexp"
-	"strings"
+	"sync/atomic"
 
-	docker "github.com/fsouza/go-dockerclient"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
 )
 
 type BindMountConfig struct {
+	// Type is the kind of mount: bind (the default), volume or tmpfs
+	Type string `json:"type,omitempty"`
+	// Source is the host path of a bind mount or the name of a volume. It is
+	// not used for tmpfs mounts.
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
+	// ReadOnly mounts the source read-only in the container
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// SELinuxLabel is the relabeling done on the source: z (shared), Z
+	// (private) or none. Bind mounts added with the binds mount style default
+	// to z, everything else defaults to none.
+	SELinuxLabel string `json:"selinuxLabel,omitempty"`
+	// Propagation is the mount propagation of a bind mount (rprivate, private,
+	// rshared, shared, rslave or slave). The Docker default is used if empty.
+	Propagation string `json:"propagation,omitempty"`
+	// TmpfsSize is the size limit in bytes of a tmpfs mount
+	TmpfsSize int64 `json:"tmpfsSize,omitempty"`
 }
 
 type EnvConfig struct {
@@ -26,83 +42,361 @@ type EnvConfig struct {
 }
 
 type ImageBindMountConfig struct {
-	ImagePattern string            `json:"imagePattern"`
-	Mounts       []BindMountConfig `json:"mounts"`
-	Env          []EnvConfig       `json:"env"`
+	// Name identifies the rule, so that configurations loaded later can
+	// replace or disable it
+	Name string `json:"name,omitempty"`
+	// Disabled rules are not applied
+	Disabled bool `json:"disabled,omitempty"`
+
+	// ImagePattern is a regular expression matched against the image of the
+	// container being created
+	ImagePattern string `json:"imagePattern,omitempty"`
+	// Image matches the image of the container by its normalized registry,
+	// repository, tag and digest
+	Image *ImageMatchConfig `json:"image,omitempty"`
+	// Match selects containers by labels, name, command, environment or
+	// image digest, in addition to ImagePattern
+	Match *MatchConfig `json:"match,omitempty"`
+	// MinAPIVersion and MaxAPIVersion restrict the rule to requests made
+	// with a Docker API version in the range, such as 1.25. Either bound may
+	// be omitted.
+	MinAPIVersion string `json:"minAPIVersion,omitempty"`
+	MaxAPIVersion string `json:"maxAPIVersion,omitempty"`
+	// MountStyle selects whether mounts are added as HostConfig.Binds (binds,
+	// the default) or as HostConfig.Mounts (mounts)
+	MountStyle string `json:"mountStyle,omitempty"`
+	// OnConflict determines what happens when the container already has
+	// something mounted at the destination of one of the rule's mounts:
+	// replace the existing mount, skip the rule's mount or fail the create
+	// request (the default)
+	OnConflict string            `json:"onConflict,omitempty"`
+	Mounts     []BindMountConfig `json:"mounts,omitempty"`
+	Env        []EnvConfig       `json:"env,omitempty"`
+
+	// Exec is applied to the exec sessions created in matching containers
+	Exec *ExecConfig `json:"exec,omitempty"`
+	// Update is applied to the update requests of matching containers
+	Update *UpdateConfig `json:"update,omitempty"`
+	// Build is applied to the image builds whose tags match the rule
+	Build *BuildConfig `json:"build,omitempty"`
+	// ReplaceImage makes matching containers run a different image
+	ReplaceImage *ReplaceImageConfig `json:"replaceImage,omitempty"`
+	// VerifyOnStart checks that matching containers have the rule's mounts
+	// when they are started, which containers created before the rule was
+	// added do not: warn logs a warning and fail refuses to start them
+	VerifyOnStart string `json:"verifyOnStart,omitempty"`
+
+	// source is the file the rule was loaded from
+	source string
+}
+
+// DockerHostConfig specifies the Docker daemon the proxy forwards requests to
+type DockerHostConfig struct {
+	Host      string `json:"host"`
+	TLSVerify bool   `json:"tlsVerify"`
+	TLSCACert string `json:"tlsCACert"`
+	TLSCert   string `json:"tlsCert"`
+	TLSKey    string `json:"tlsKey"`
 }
 
 type BindMountProxyConfig struct {
-	BindMounts []ImageBindMountConfig `json:"bindMounts"`
+	// APIVersion and Kind identify the configuration schema
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+
+	// Include lists files and directories whose configuration is merged
+	// into this one. Paths are relative to the directory of the including file.
+	Include []string `json:"include,omitempty"`
+
+	DockerHost *DockerHostConfig `json:"dockerHost,omitempty"`
+	// HideInjected removes the mounts and environment variables added by
+	// the proxy from the inspect output of the containers it created, so
+	// that clients see the containers they asked for
+	HideInjected bool                   `json:"hideInjected,omitempty"`
+	BindMounts   []ImageBindMountConfig `json:"bindMounts"`
+
+	// Sources are the files and directories the configuration was loaded from
+	Sources []string `json:"-"`
+}
+
+// Proxy is a Docker proxy that adds bind mounts and environment variables to
+// containers created through it. Its configuration can be replaced while it is
+// serving requests.
+type Proxy struct {
+	handler http.Handler
+	backend *dockerproxy.Backend
+	rules   atomic.Value // *RuleSet
+	images  imageInspector
+	// containers inspects the containers of exec, update and start requests
+	containers containerInspector
+	metrics    *prometheus.Registry
+	audit      *auditLog
+	// injections remembers what was added to each created container
+	injections *injectionStore
+}
+
+// BindMountInterceptor is the name of the interceptor that applies the bind
+// mount rules
+const BindMountInterceptor = "bindmount"
+
+// metricsNamespace is the prefix of the names of the proxy metrics
+const metricsNamespace = "bindmountproxy"
+
+// New returns a proxy with the given configuration that forwards requests to
+// backend. The rules are applied by the first interceptors of the proxy, for
+// container create requests, requests on existing containers, builds and image
+// pulls; the given interceptors follow them in order, so they see requests
+// after the rules were applied.
+func New(config *BindMountProxyConfig, backend *dockerproxy.Backend, interceptors ...dockerproxy.Interceptor) (*Proxy, error) {
+	client := newDaemonClient(backend)
+	p := &Proxy{
+		backend:    backend,
+		images:     client,
+		containers: client,
+		metrics:    prometheus.NewRegistry(),
+
+		injections: newInjectionStore(),
+	}
+	if err := p.Reload(config); err != nil {
+		return nil, err
+	}
+	ruleMatches := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_matches_total",
+		Help:      "Containers created by the daemon from requests each rule was applied to, by rule name (or position if it has none).",
+	}, []string{"rule"})
+	missingMounts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_mounts_total",
+		Help:      "Container starts where the container lacked the mounts of a rule that verifies them, by rule name (or position if it has none).",
+	}, []string{"rule"})
+	p.metrics.MustRegister(ruleMatches, missingMounts)
+	pipeline := dockerproxy.NewPipeline(dockerproxy.Interceptor{
+		Name:   BindMountInterceptor,
+		Routes: []dockerproxy.Route{dockerproxy.RouteContainerCreate, dockerproxy.RouteContainerInspect},
+		Before: dockerproxy.ModifyRequest(bindMountRequestModifier(p.Rules, p.images)),
+		After:  bindMountResponseModifier(p.Rules, p.injections, ruleMatches),
+	}, dockerproxy.Interceptor{
+		Name:   ContainerInterceptor,
+		Routes: []dockerproxy.Route{dockerproxy.RouteExecCreate, dockerproxy.RouteContainerUpdate, dockerproxy.RouteContainerStart},
+		Before: dockerproxy.ModifyRequest(containerRequestModifier(p.Rules, p.images, p.containers, missingMounts)),
+	}, dockerproxy.Interceptor{
+		Name:   BuildInterceptor,
+		Routes: []dockerproxy.Route{dockerproxy.RouteBuild},
+		Before: dockerproxy.ModifyRequest(buildRequestModifier(p.Rules)),
+	}, dockerproxy.Interceptor{
+		Name:   ImageInterceptor,
+		Routes: []dockerproxy.Route{dockerproxy.RouteImagePull},
+		Before: imagePullModifier(p.Rules, p.images),
+	})
+	for _, interceptor := range interceptors {
+		pipeline.Add(interceptor)
+	}
+	p.handler = dockerproxy.New(backend, pipeline, dockerproxy.NewMetrics(p.metrics, metricsNamespace))
+	return p, nil
+}
+
+// Metrics returns a handler that serves the metrics of the proxy in the
+// Prometheus text format. It is kept apart from the proxy handler so that it
+// can be served on a different listener.
+func (p *Proxy) Metrics() http.Handler {
+	return promhttp.HandlerFor(p.metrics, promhttp.HandlerOpts{})
+}
+
+// SetAuditLog makes the proxy write a JSON audit record to w for every
+// container create request it handles. It must be called before the proxy
+// serves requests.
+func (p *Proxy) SetAuditLog(w io.Writer) {
+	p.audit = &auditLog{w: w}
+}
+
+// ServeHTTP proxies the request to the Docker daemon
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if p.audit != nil && isContainerCreate(req) {
+		p.audit.serveAudited(p.handler, w, req)
+		return
+	}
+	p.handler.ServeHTTP(w, req)
+}
+
+// Reload replaces the active configuration. If the new configuration is
+// invalid, an error is returned and the current configuration stays in effect.
+func (p *Proxy) Reload(config *BindMountProxyConfig) error {
+	rules, err := NewRuleSet(config)
+	if err != nil {
+		return err
+	}
+	p.SetRules(rules)
+	return nil
+}
+
+// SetRules atomically replaces the active rule set
+func (p *Proxy) SetRules(rules *RuleSet) {
+	p.rules.Store(rules)
 }
 
-func New(config *BindMountProxyConfig) http.Handler {
-	requestModifier := bindMountRequestModifier(config)
-	return dockerproxy.New(requestModifier)
+// Rules returns the active rule set
+func (p *Proxy) Rules() *RuleSet {
+	return p.rules.Load().(*RuleSet)
 }
 
+// Config returns the active configuration
+func (p *Proxy) Config() *BindMountProxyConfig {
+	return p.Rules().Config()
+}
+
+// createContainerData is the part of a container create request that rules
+// are matched against. The request is modified through its createDocument.
 type createContainerData struct {
-	*docker.Config
-	HostConfig *docker.HostConfig `json:"HostConfig,omitempty"`
+	Image      string            `json:"Image"`
+	Labels     map[string]string `json:"Labels"`
+	Env        []string          `json:"Env"`
+	Cmd        strSlice          `json:"Cmd"`
+	Entrypoint strSlice          `json:"Entrypoint"`
 }
 
-func bindMountRequestModifier(config *BindMountProxyConfig) dockerproxy.RequestModifierFunc {
+func bindMountRequestModifier(rules func() *RuleSet, images imageInspector) dockerproxy.RequestModifierFunc {
 	return func(req *http.Request) (*http.Request, error) {
-		if isContainerCreate(req) {
+		if route := dockerproxy.RouteOf(req); route.Route == dockerproxy.RouteContainerCreate {
 			body, err := ioutil.ReadAll(req.Body)
 			if err != nil {
-				// Log error
-				return nil, err
-			}
-			decoder := json.NewDecoder(bytes.NewBuffer(body))
-			data := &createContainerData{}
-			err = decoder.Decode(data)
-			if err != nil {
-				glog.Errorf("Error decoding container create data: %v", err)
-				return nil, err
+				return nil, dockerproxy.BadRequest("cannot read container create request: %v", err)
 			}
-			err = addBindMounts(config, data)
-			if err != nil {
-				glog.Errorf("Error adding bind mounts: %v", err)
-				return nil, err
+			rewrite, err := rewriteCreate(rules(), body, req.URL.Query().Get("name"), route.Version, images)
+			if record := auditRecordFrom(req.Context()); record != nil {
+				record.rewritten(rewrite, err)
 			}
-
-			newBody := &bytes.Buffer{}
-			encoder := json.NewEncoder(newBody)
-			encoder.Encode(data)
-			newReq, err := http.NewRequest(req.Method, req.URL.String(), ioutil.NopCloser(newBody))
 			if err != nil {
 				return nil, err
 			}
-			newReq.Header = req.Header
-			return newReq, nil
+			return withBody(req.WithContext(context.WithValue(req.Context(), createRewriteKey{}, rewrite)), bytes.NewReader(rewrite.body))
 		}
 		return req, nil
 	}
 }
 
-func addBindMounts(config *BindMountProxyConfig, data *createContainerData) error {
-	if config == nil {
-		return nil
+// withBody returns a copy of a request, with its context, that sends body
+// instead of the body of the request. The length of the body is only set if
+// body is in memory; other bodies are streamed.
+func withBody(req *http.Request, body io.Reader) (*http.Request, error) {
+	newReq, err := http.NewRequest(req.Method, req.URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	newReq = newReq.WithContext(req.Context())
+	if newReq.ContentLength == 0 && newReq.Body != http.NoBody {
+		// The reverse proxy drops bodies of length 0, so a body of unknown
+		// length has to be marked as such
+		newReq.ContentLength = -1
+	}
+	newReq.Header = req.Header
+	newReq.Header.Del("Content-Length")
+	return newReq, nil
+}
+
+// createRewrite is the outcome of applying the rules to a container create
+// request
+type createRewrite struct {
+	// body is the request to send to the daemon. It is empty if the request
+	// is rejected.
+	body []byte
+	// image and name are the image and name of the container
+	image string
+	name  string
+	// replacedImage is the image the container is created from instead of
+	// image, if a rule replaced it
+	replacedImage string
+	// rules holds the result of matching each enabled rule
+	rules []RuleResult
+	// mounts and env are the mounts and environment variables that were added
+	mounts []BindMountConfig
+	env    []string
+}
+
+// rewriteCreate applies the rules to the body of a container create request
+// for a container with the given name, made with the given API version. The
+// returned rewrite is never nil, and describes the rules that were matched even
+// if the request is rejected.
+func rewriteCreate(rules *RuleSet, body []byte, name string, version dockerproxy.APIVersion, images imageInspector) (*createRewrite, error) {
+	rewrite := &createRewrite{name: name}
+	doc, err := parseCreateDocument(body)
+	if err != nil {
+		glog.Errorf("Error decoding container create data: %v", err)
+		return rewrite, dockerproxy.BadRequest("invalid container create request: %v", err)
 	}
-	for _, imageConfig := range config.BindMounts {
-		re, err := regexp.Compile(imageConfig.ImagePattern)
-		if err != nil {
-			// Log error
-			return err
+	data := doc.containerData()
+	rewrite.image = data.Image
+	err = addBindMounts(rules, &createRequest{
+		data:       data,
+		name:       name,
+		apiVersion: version,
+		images:     images,
+	}, doc, rewrite)
+	if err != nil {
+		glog.Errorf("Error adding bind mounts: %v", err)
+		return rewrite, err
+	}
+	if rewrite.body, err = doc.encode(); err != nil {
+		return rewrite, fmt.Errorf("cannot encode container create request: %v", err)
+	}
+	return rewrite, nil
+}
+
+// addBindMounts adds the mounts and environment variables of the rules that
+// match the request to doc and replaces its image, recording what it does in
+// rewrite
+func addBindMounts(rules *RuleSet, req *createRequest, doc *createDocument, rewrite *createRewrite) error {
+	// Match every rule against the request as the client sent it, before
+	// any rule modifies it
+	var matched []*rule
+	for _, r := range rules.rules {
+		ok, reason := r.match(req)
+		if ok {
+			matched = append(matched, r)
+		} else {
+			glog.V(4).Infof("Rule %d does not apply: %s", r.index, reason)
 		}
-		if re.MatchString(data.Image) {
-			for _, mount := range imageConfig.Mounts {
-				data.HostConfig.Binds = append(data.HostConfig.Binds,
-					fmt.Sprintf("%s:%s:z", mount.Source, mount.Destination))
+		rewrite.rules = append(rewrite.rules, r.result(ok, reason))
+	}
+	if err := replaceImage(matched, req, doc, rewrite); err != nil {
+		return err
+	}
+	for _, imageConfig := range matched {
+		for _, mount := range imageConfig.Mounts {
+			mounted, err := doc.isMounted(mount.Destination)
+			if err != nil {
+				return dockerproxy.BadRequest("invalid container create request: %v", err)
 			}
-			for _, env := range imageConfig.Env {
-				data.Env = append(data.Env, fmt.Sprintf("%s=%s", env.Name, env.Value))
+			if mounted {
+				switch imageConfig.OnConflict {
+				case ConflictSkip:
+					glog.V(2).Infof("Not mounting %s, the container already has a mount there", mount.Destination)
+					continue
+				case ConflictReplace:
+					glog.V(2).Infof("Replacing existing mount at %s", mount.Destination)
+					if err = doc.unmount(mount.Destination); err != nil {
+						return dockerproxy.BadRequest("invalid container create request: %v", err)
+					}
+				default:
+					return dockerproxy.BadRequest("cannot mount %s at %s: the container already has a mount at that destination", mount.Source, mount.Destination)
+				}
+			}
+			if err = doc.addMount(imageConfig.MountStyle, mount); err != nil {
+				return dockerproxy.BadRequest("invalid container create request: %v", err)
+			}
+			rewrite.mounts = append(rewrite.mounts, mount)
+		}
+		for _, env := range imageConfig.Env {
+			v := fmt.Sprintf("%s=%s", env.Name, env.Value)
+			if err := doc.appendEnv(v); err != nil {
+				return dockerproxy.BadRequest("invalid container create request: %v", err)
 			}
+			rewrite.env = append(rewrite.env, v)
 		}
 	}
 	return nil
 }
 
 func isContainerCreate(req *http.Request) bool {
-	return strings.HasSuffix(req.URL.Path, "/containers/create")
+	return dockerproxy.RouteOf(req).Route == dockerproxy.RouteContainerCreate
 }
@@ -0,0 +1,391 @@
+package bindmountproxy
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// BuildInterceptor is the name of the interceptor that applies rules to image
+// builds
+const BuildInterceptor = "build-rules"
+
+// maxDockerfileSize is the largest Dockerfile whose FROM instructions can be
+// replaced. The Dockerfile is the only part of a build context that is held
+// in memory.
+const maxDockerfileSize = 1024 * 1024
+
+// BuildConfig is applied to the image builds whose tags match the rule
+type BuildConfig struct {
+	// Args are added to the build arguments, replacing those of the client
+	// with the same name
+	Args []EnvConfig `json:"args,omitempty"`
+	// Files are added to the build context, replacing the files of the
+	// client at the same path
+	Files []BuildFileConfig `json:"files,omitempty"`
+	// ReplaceFrom maps images used by FROM instructions of the Dockerfile to
+	// the images to build from instead
+	ReplaceFrom map[string]string `json:"replaceFrom,omitempty"`
+}
+
+// BuildFileConfig is a host file added to build contexts
+type BuildFileConfig struct {
+	Source string `json:"source"`
+	// Destination is the path of the file in the build context, relative to
+	// its root
+	Destination string `json:"destination"`
+}
+
+func validateBuild(build *BuildConfig, invalid func(field, format string, args ...interface{})) {
+	for i, arg := range build.Args {
+		if msg := validateEnvName(arg.Name); len(msg) > 0 {
+			invalid(fmt.Sprintf("build.args[%d].name", i), "%s", msg)
+		}
+	}
+	for i, file := range build.Files {
+		field := fmt.Sprintf("build.files[%d].", i)
+		switch {
+		case len(file.Source) == 0:
+			invalid(field+"source", "a source path is required")
+		case !filepath.IsAbs(file.Source):
+			invalid(field+"source", "%q is not an absolute path", file.Source)
+		default:
+			if info, err := os.Stat(file.Source); err != nil {
+				invalid(field+"source", "%v", err)
+			} else if !info.Mode().IsRegular() {
+				invalid(field+"source", "%q is not a regular file", file.Source)
+			}
+		}
+		switch destination := contextPath(file.Destination); {
+		case len(file.Destination) == 0:
+			invalid(field+"destination", "a destination path is required")
+		case path.IsAbs(file.Destination):
+			invalid(field+"destination", "%q must be relative to the root of the build context", file.Destination)
+		case destination == "." || destination == ".." || strings.HasPrefix(destination, "../"):
+			invalid(field+"destination", "%q is not a file in the build context", file.Destination)
+		}
+	}
+	for from, to := range build.ReplaceFrom {
+		if len(from) == 0 || len(to) == 0 {
+			invalid("build.replaceFrom", "images must not be empty")
+		}
+	}
+}
+
+// buildRewrite is what the rules that match a build change in it
+type buildRewrite struct {
+	args map[string]string
+	// files maps paths in the build context to the host files added there
+	files     map[string]string
+	fileOrder []string
+	from      map[string]string
+}
+
+func newBuildRewrite(matched []*rule) *buildRewrite {
+	b := &buildRewrite{args: map[string]string{}, files: map[string]string{}, from: map[string]string{}}
+	// Rules that come later override earlier ones
+	for _, r := range matched {
+		for _, arg := range r.Build.Args {
+			b.args[arg.Name] = arg.Value
+		}
+		for _, file := range r.Build.Files {
+			destination := contextPath(file.Destination)
+			if _, exists := b.files[destination]; !exists {
+				b.fileOrder = append(b.fileOrder, destination)
+			}
+			b.files[destination] = file.Source
+		}
+		for from, to := range r.Build.ReplaceFrom {
+			b.from[from] = to
+		}
+	}
+	return b
+}
+
+// changesContext returns whether the build context has to be rewritten
+func (b *buildRewrite) changesContext() bool {
+	return len(b.files) > 0 || len(b.from) > 0
+}
+
+// contextSettings describes the settings of the matched rules that change the
+// build context, for example "files and replaceFrom of rule origin"
+func contextSettings(matched []*rule) string {
+	var settings []string
+	for _, r := range matched {
+		var fields []string
+		if len(r.Build.Files) > 0 {
+			fields = append(fields, "files")
+		}
+		if len(r.Build.ReplaceFrom) > 0 {
+			fields = append(fields, "replaceFrom")
+		}
+		if len(fields) > 0 {
+			settings = append(settings, fmt.Sprintf("%s of rule %s", strings.Join(fields, " and "), r.label()))
+		}
+	}
+	return strings.Join(settings, ", ")
+}
+
+// buildRequestModifier applies the rules to image builds. Rules are matched
+// against the tags of the image being built, and the labels given to it.
+func buildRequestModifier(rules func() *RuleSet) dockerproxy.RequestModifierFunc {
+	return func(req *http.Request) (*http.Request, error) {
+		route := dockerproxy.RouteOf(req)
+		if route.Route != dockerproxy.RouteBuild {
+			return req, nil
+		}
+		query := req.URL.Query()
+		matched, err := matchBuild(rules(), query, route.Version)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) == 0 {
+			return req, nil
+		}
+		build := newBuildRewrite(matched)
+		if err = build.setArgs(query); err != nil {
+			return nil, err
+		}
+		newReq := req.WithContext(req.Context())
+		if build.changesContext() {
+			// Rather than building an image without the content the rules add
+			// to it, builds whose context cannot be rewritten are rejected
+			switch {
+			case query.Get("version") == "2":
+				return nil, dockerproxy.BadRequest("%s cannot be applied to a BuildKit build, its context is not sent with the request", contextSettings(matched))
+			case len(query.Get("remote")) > 0:
+				return nil, dockerproxy.BadRequest("%s cannot be applied to a build of remote context %s", contextSettings(matched), query.Get("remote"))
+			}
+			dockerfile := query.Get("dockerfile")
+			if len(dockerfile) == 0 {
+				dockerfile = "Dockerfile"
+			}
+			if newReq, err = withBody(req, build.rewriteContext(req.Body, contextPath(dockerfile))); err != nil {
+				return nil, err
+			}
+		}
+		u := *req.URL
+		u.RawQuery = query.Encode()
+		newReq.URL = &u
+		return newReq, nil
+	}
+}
+
+// matchBuild returns the rules with build settings that match a build
+func matchBuild(rules *RuleSet, query url.Values, version dockerproxy.APIVersion) ([]*rule, error) {
+	var candidates []*rule
+	for _, r := range rules.rules {
+		if r.Build != nil {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	if encoded := query.Get("labels"); len(encoded) > 0 {
+		if err := json.Unmarshal([]byte(encoded), &labels); err != nil {
+			return nil, dockerproxy.BadRequest("invalid build labels: %v", err)
+		}
+	}
+	// A build is matched as a create request for each of its tags. The image
+	// does not exist yet, so it is not inspected.
+	tags := query["t"]
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	var matched []*rule
+	for _, r := range candidates {
+		for _, tag := range tags {
+			req := &createRequest{
+				data:       &createContainerData{Image: tag, Labels: labels},
+				apiVersion: version,
+			}
+			ok, reason := r.match(req)
+			if ok {
+				matched = append(matched, r)
+				break
+			}
+			glog.V(4).Infof("Rule %d does not apply to build of %q: %s", r.index, tag, reason)
+		}
+	}
+	return matched, nil
+}
+
+// setArgs adds the build arguments to the query of a build request
+func (b *buildRewrite) setArgs(query url.Values) error {
+	if len(b.args) == 0 {
+		return nil
+	}
+	// Arguments given without a value are null, so values are kept as
+	// pointers to encode them again unchanged
+	args := map[string]*string{}
+	if encoded := query.Get("buildargs"); len(encoded) > 0 {
+		if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+			return dockerproxy.BadRequest("invalid build arguments: %v", err)
+		}
+	}
+	for name, value := range b.args {
+		value := value
+		args[name] = &value
+	}
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	query.Set("buildargs", string(encoded))
+	return nil
+}
+
+// rewriteContext returns a stream of the build context read from context,
+// with the files of the rules added and the FROM instructions of the given
+// Dockerfile replaced. The context is rewritten as it is read.
+func (b *buildRewrite) rewriteContext(context io.ReadCloser, dockerfile string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		defer context.Close()
+		err := b.copyContext(writer, context, dockerfile)
+		if err != nil {
+			glog.Errorf("Error rewriting build context: %v", err)
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+func (b *buildRewrite) copyContext(w io.Writer, r io.Reader, dockerfile string) error {
+	r, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	in := tar.NewReader(r)
+	out := tar.NewWriter(w)
+	for {
+		hdr, err := in.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read build context: %v", err)
+		}
+		name := contextPath(hdr.Name)
+		if _, replaced := b.files[name]; replaced {
+			glog.V(2).Infof("Replacing %s in the build context", name)
+			continue
+		}
+		if name == dockerfile && len(b.from) > 0 && hdr.FileInfo().Mode().IsRegular() {
+			data, err := ioutil.ReadAll(io.LimitReader(in, maxDockerfileSize+1))
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %v", name, err)
+			}
+			if len(data) > maxDockerfileSize {
+				return fmt.Errorf("cannot replace FROM images, %s is larger than %d bytes", name, maxDockerfileSize)
+			}
+			data = replaceFrom(data, b.from)
+			hdr.Size = int64(len(data))
+			if err = out.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err = out.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = out.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			return err
+		}
+	}
+	for _, destination := range b.fileOrder {
+		if err = addContextFile(out, destination, b.files[destination]); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// decompress returns the uncompressed stream of a build context. The daemon
+// accepts uncompressed contexts, so the rewritten context is not compressed
+// again.
+func decompress(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read build context: %v", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buf)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(buf), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return nil, fmt.Errorf("xz compressed build contexts cannot be rewritten")
+	}
+	return buf, nil
+}
+
+// fromInstruction matches the FROM instructions of a Dockerfile, with the
+// image as its second group
+var fromInstruction = regexp.MustCompile(`(?im)^(\s*FROM\s+(?:--\S+\s+)*)(\S+)`)
+
+// replaceFrom replaces the images of the FROM instructions of a Dockerfile
+func replaceFrom(dockerfile []byte, images map[string]string) []byte {
+	return fromInstruction.ReplaceAllFunc(dockerfile, func(instruction []byte) []byte {
+		groups := fromInstruction.FindSubmatch(instruction)
+		image, ok := images[string(groups[2])]
+		if !ok {
+			return instruction
+		}
+		glog.V(2).Infof("Building from %s instead of %s", image, groups[2])
+		return append(append([]byte{}, groups[1]...), image...)
+	})
+}
+
+// addContextFile adds a host file to a build context
+func addContextFile(out *tar.Writer, destination, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("cannot add %s to the build context: %v", source, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot add %s to the build context: %v", source, err)
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("cannot add %s to the build context: %v", source, err)
+	}
+	hdr.Name = destination
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err = out.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	return err
+}
+
+// contextPath returns the path of a file in a build context in the form used
+// to compare paths, without a leading ./ or /
+func contextPath(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "/"))
+}
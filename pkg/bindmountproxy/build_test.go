@@ -0,0 +1,197 @@
+package bindmountproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+func TestReplaceFrom(t *testing.T) {
+	images := map[string]string{
+		"centos:7":    "registry.local/centos:7",
+		"golang:1.8":  "registry.local/golang:1.8",
+		"other:image": "unused",
+	}
+	tests := []struct {
+		dockerfile string
+		expected   string
+	}{
+		{"FROM centos:7\nRUN true\n", "FROM registry.local/centos:7\nRUN true\n"},
+		{"from centos:7", "from registry.local/centos:7"},
+		{"  FROM   centos:7 AS base\n", "  FROM   registry.local/centos:7 AS base\n"},
+		{"FROM --platform=linux/amd64 golang:1.8 AS build\nFROM centos:7\nCOPY --from=build /out /\n",
+			"FROM --platform=linux/amd64 registry.local/golang:1.8 AS build\nFROM registry.local/centos:7\nCOPY --from=build /out /\n"},
+		{"FROM centos:7.1\n", "FROM centos:7.1\n"},
+		{"RUN echo FROM centos:7\n", "RUN echo FROM centos:7\n"},
+		{"# FROM centos:7\n", "# FROM centos:7\n"},
+	}
+	for _, test := range tests {
+		if actual := string(replaceFrom([]byte(test.dockerfile), images)); actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.dockerfile, test.expected, actual)
+		}
+	}
+}
+
+type contextFile struct {
+	name string
+	data string
+}
+
+func writeContext(t *testing.T, compress bool, files ...contextFile) []byte {
+	buf := &bytes.Buffer{}
+	var w io.Writer = buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readContext(t *testing.T, data []byte) []contextFile {
+	var files []contextFile
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("invalid rewritten context: %v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("invalid rewritten context: %v", err)
+		}
+		files = append(files, contextFile{hdr.Name, string(content)})
+	}
+}
+
+func TestCopyContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "openshift")
+	if err = ioutil.WriteFile(binary, []byte("new binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config")
+	if err = ioutil.WriteFile(config, []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBuildRewrite([]*rule{{ImageBindMountConfig: ImageBindMountConfig{Build: &BuildConfig{
+		Files: []BuildFileConfig{
+			{Source: binary, Destination: "bin/openshift"},
+			{Source: config, Destination: "/etc/config"},
+		},
+		ReplaceFrom: map[string]string{"centos:7": "registry.local/centos:7"},
+	}}}})
+	for _, compress := range []bool{false, true} {
+		in := writeContext(t, compress,
+			contextFile{"Dockerfile", "FROM --platform=linux/amd64 centos:7\nCOPY bin/openshift /usr/bin/\n"},
+			contextFile{"./bin/openshift", "old binary"},
+			contextFile{"README", "FROM centos:7"},
+		)
+		out := &bytes.Buffer{}
+		if err = b.copyContext(out, bytes.NewReader(in), "Dockerfile"); err != nil {
+			t.Errorf("compressed %t: unexpected error: %v", compress, err)
+			continue
+		}
+		expected := []contextFile{
+			{"Dockerfile", "FROM --platform=linux/amd64 registry.local/centos:7\nCOPY bin/openshift /usr/bin/\n"},
+			{"README", "FROM centos:7"},
+			{"bin/openshift", "new binary"},
+			{"etc/config", "added"},
+		}
+		if actual := readContext(t, out.Bytes()); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("compressed %t: expected %v, got %v", compress, expected, actual)
+		}
+	}
+}
+
+func TestCopyContextDockerfileTooLarge(t *testing.T) {
+	b := newBuildRewrite([]*rule{{ImageBindMountConfig: ImageBindMountConfig{Build: &BuildConfig{
+		ReplaceFrom: map[string]string{"centos:7": "registry.local/centos:7"},
+	}}}})
+	dockerfile := "FROM centos:7\n" + strings.Repeat("#", maxDockerfileSize)
+	in := writeContext(t, false, contextFile{"build/Dockerfile", dockerfile})
+	err := b.copyContext(ioutil.Discard, bytes.NewReader(in), "build/Dockerfile")
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected an error about the size of the Dockerfile, got %v", err)
+	}
+
+	// Dockerfiles are only read when their FROM instructions are replaced
+	b = newBuildRewrite(nil)
+	if err = b.copyContext(ioutil.Discard, bytes.NewReader(in), "build/Dockerfile"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildRequestModifierContextNotSent(t *testing.T) {
+	rules, err := NewRuleSet(&BindMountProxyConfig{BindMounts: []ImageBindMountConfig{
+		{Name: "args", ImagePattern: ".", Build: &BuildConfig{Args: []EnvConfig{{Name: "VERSION", Value: "3.6"}}}},
+		{Name: "from", ImagePattern: "own", Build: &BuildConfig{ReplaceFrom: map[string]string{"centos:7": "registry.local/centos:7"}}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	modify := buildRequestModifier(func() *RuleSet { return rules })
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "t=own&version=2", expected: "replaceFrom of rule from cannot be applied to a BuildKit build"},
+		{query: "t=own&remote=https://example.com/context.tar", expected: "replaceFrom of rule from cannot be applied to a build of remote context"},
+		// Rules that only set build arguments apply to any build
+		{query: "t=other&version=2"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://docker/v1.39/build?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = modify(req)
+		if len(test.expected) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.query, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.query, test.expected, err)
+		}
+		if requestErr, ok := err.(*dockerproxy.RequestError); !ok || requestErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected a bad request, got %#v", test.query, err)
+		}
+	}
+}
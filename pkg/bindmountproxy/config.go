@@ -0,0 +1,364 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration schema identifiers. Configurations without an apiVersion and
+// kind are assumed to use the current schema.
+const (
+	ConfigAPIVersion = "bindmountproxy/v1"
+	ConfigKind       = "BindMountProxyConfig"
+)
+
+// LoadConfigFile reads a proxy configuration from the given file. The format
+// is determined by the file extension: .yaml and .yml files are read as YAML,
+// .toml files as TOML and everything else as JSON.
+//
+// Files and directories listed in the configuration's include are loaded and
+// merged after the file's own rules, in the order they are listed. Files in an
+// included directory are merged in lexical order. When a rule has the same
+// name as a rule merged before it, it replaces that rule. A rule that only has
+// a name and disabled set disables the earlier rule instead.
+func LoadConfigFile(path string) (*BindMountProxyConfig, error) {
+	l := &configLoader{loading: map[string]bool{}}
+	cfg, err := l.load(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Include = nil
+	cfg.Sources = l.sources
+	return cfg, nil
+}
+
+type configLoader struct {
+	// loading holds the files being loaded, to detect include cycles
+	loading map[string]bool
+	sources []string
+}
+
+func (l *configLoader) load(path string) (*BindMountProxyConfig, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if l.loading[abs] {
+		return nil, fmt.Errorf("configuration %s includes itself", path)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+	l.sources = append(l.sources, path)
+
+	configData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration: %v", err)
+	}
+	fileCfg, err := ParseConfig(configData, configFormat(path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+	for i := range fileCfg.BindMounts {
+		fileCfg.BindMounts[i].source = path
+	}
+
+	cfg := &BindMountProxyConfig{
+		APIVersion: fileCfg.APIVersion,
+		Kind:       fileCfg.Kind,
+	}
+	mergeConfig(cfg, fileCfg)
+	for _, include := range fileCfg.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		files, err := l.includedFiles(include)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include in %s: %v", path, err)
+		}
+		for _, file := range files {
+			included, err := l.load(file)
+			if err != nil {
+				return nil, err
+			}
+			mergeConfig(cfg, included)
+		}
+	}
+	return cfg, nil
+}
+
+// includedFiles returns the configuration files to load for an include
+func (l *configLoader) includedFiles(include string) ([]string, error) {
+	info, err := os.Stat(include)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{include}, nil
+	}
+	l.sources = append(l.sources, include)
+	entries, err := ioutil.ReadDir(include)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yaml", ".yml", ".toml":
+			files = append(files, filepath.Join(include, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// mergeConfig merges the settings and rules of src into dst
+func mergeConfig(dst, src *BindMountProxyConfig) {
+	if src.DockerHost != nil {
+		dst.DockerHost = src.DockerHost
+	}
+	if src.HideInjected {
+		dst.HideInjected = true
+	}
+	for _, r := range src.BindMounts {
+		existing := -1
+		if len(r.Name) > 0 {
+			for i := range dst.BindMounts {
+				if dst.BindMounts[i].Name == r.Name {
+					existing = i
+					break
+				}
+			}
+		}
+		switch {
+		case existing < 0:
+			dst.BindMounts = append(dst.BindMounts, r)
+		case isDisableOnly(r):
+			dst.BindMounts[existing].Disabled = true
+		default:
+			dst.BindMounts[existing] = r
+		}
+	}
+}
+
+// isDisableOnly returns whether a rule only consists of a name and disabled,
+// which disables an existing rule with that name
+func isDisableOnly(r ImageBindMountConfig) bool {
+	return reflect.DeepEqual(r, ImageBindMountConfig{Name: r.Name, Disabled: true, source: r.source})
+}
+
+// Configuration file formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// ParseConfig parses a configuration in the given format. Fields that are not
+// part of the configuration schema are rejected.
+func ParseConfig(data []byte, format string) (*BindMountProxyConfig, error) {
+	var doc interface{}
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		doc = convertYAML(doc)
+	case FormatTOML:
+		tomlDoc := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &tomlDoc); err != nil {
+			return nil, err
+		}
+		doc = tomlDoc
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", format)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("configuration is empty")
+	}
+
+	var unknown []string
+	checkFields(doc, reflect.TypeOf(BindMountProxyConfig{}), "", &unknown)
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(unknown, "; "))
+	}
+
+	// Every format is decoded through JSON so that the json field tags of
+	// the configuration types apply to all of them
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &BindMountProxyConfig{}
+	if err = json.Unmarshal(jsonData, cfg); err != nil {
+		return nil, err
+	}
+	if err = checkSchema(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// MarshalConfig writes a configuration in the given format, using the same
+// field names that ParseConfig accepts
+func MarshalConfig(cfg *BindMountProxyConfig, format string) ([]byte, error) {
+	jsonData, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatJSON {
+		return append(jsonData, '\n'), nil
+	}
+	// YAML and TOML are encoded from a generic document, so that the json
+	// field tags of the configuration types apply to them as well
+	var doc map[string]interface{}
+	if err = json.Unmarshal(jsonData, &doc); err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(doc)
+	case FormatTOML:
+		buf := &bytes.Buffer{}
+		if err = toml.NewEncoder(buf).Encode(doc); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown configuration format %q", format)
+}
+
+func checkSchema(cfg *BindMountProxyConfig) error {
+	if len(cfg.APIVersion) == 0 && len(cfg.Kind) == 0 {
+		return nil
+	}
+	if cfg.APIVersion != ConfigAPIVersion {
+		return fmt.Errorf("apiVersion: unsupported version %q, expected %q", cfg.APIVersion, ConfigAPIVersion)
+	}
+	if cfg.Kind != ConfigKind {
+		return fmt.Errorf("kind: unsupported kind %q, expected %q", cfg.Kind, ConfigKind)
+	}
+	return nil
+}
+
+// convertYAML converts the map[interface{}]interface{} values produced by the
+// YAML decoder into map[string]interface{} so that they can be encoded as JSON
+func convertYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprintf("%v", key)] = convertYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertYAML(item)
+		}
+	}
+	return value
+}
+
+// checkFields walks a decoded configuration document alongside the type it
+// will be decoded into and records every key that does not correspond to a
+// field, with its path in the document
+func checkFields(value interface{}, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if len(path) > 0 {
+				fieldPath = path + "." + key
+			}
+			field, ok := fields[key]
+			if !ok {
+				msg := fmt.Sprintf("%s: unknown field", fieldPath)
+				for name := range fields {
+					if strings.EqualFold(name, key) {
+						msg += fmt.Sprintf(" (did you mean %q?)", name)
+					}
+				}
+				*unknown = append(*unknown, msg)
+				continue
+			}
+			checkFields(m[key], field.Type, fieldPath, unknown)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			// TOML arrays of tables are decoded as slices of maps
+			if tables, isTables := value.([]map[string]interface{}); isTables {
+				for _, table := range tables {
+					items = append(items, table)
+				}
+			}
+		}
+		for i, item := range items {
+			checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), unknown)
+		}
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, item := range m {
+			checkFields(item, t.Elem(), fmt.Sprintf("%s[%s]", path, key), unknown)
+		}
+	}
+}
+
+// jsonFields returns the fields of a struct type by their JSON names
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || len(field.PkgPath) > 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
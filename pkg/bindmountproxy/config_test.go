@@ -0,0 +1,201 @@
+package bindmountproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfig(t *testing.T) {
+	origin := ImageBindMountConfig{Name: "origin", ImagePattern: "origin", Mounts: []BindMountConfig{{Source: "/a", Destination: "/a"}}}
+	node := ImageBindMountConfig{Name: "node", ImagePattern: "node", Mounts: []BindMountConfig{{Source: "/b", Destination: "/b"}}}
+	unnamed := ImageBindMountConfig{ImagePattern: "other", Mounts: []BindMountConfig{{Source: "/c", Destination: "/c"}}}
+	newOrigin := ImageBindMountConfig{Name: "origin", ImagePattern: "origin", Mounts: []BindMountConfig{{Source: "/new", Destination: "/a"}}}
+	disabledOrigin := origin
+	disabledOrigin.Disabled = true
+	tests := []struct {
+		name     string
+		dst      BindMountProxyConfig
+		src      BindMountProxyConfig
+		expected BindMountProxyConfig
+	}{
+		{
+			name:     "append",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{origin}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{node, unnamed}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{origin, node, unnamed}},
+		},
+		{
+			name:     "unnamed rules are never replaced",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{unnamed}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{unnamed}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{unnamed, unnamed}},
+		},
+		{
+			name:     "override by name keeps the position",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{origin, node}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{newOrigin}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{newOrigin, node}},
+		},
+		{
+			name:     "disable by name",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{origin, node}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{{Name: "origin", Disabled: true}}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{disabledOrigin, node}},
+		},
+		{
+			name:     "disable unknown name",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{node}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{{Name: "origin", Disabled: true}}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{node, {Name: "origin", Disabled: true}}},
+		},
+		{
+			name:     "a disabled rule with settings replaces the rule",
+			dst:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{origin}},
+			src:      BindMountProxyConfig{BindMounts: []ImageBindMountConfig{{Name: "origin", Disabled: true, ImagePattern: "x"}}},
+			expected: BindMountProxyConfig{BindMounts: []ImageBindMountConfig{{Name: "origin", Disabled: true, ImagePattern: "x"}}},
+		},
+		{
+			name:     "settings",
+			dst:      BindMountProxyConfig{DockerHost: &DockerHostConfig{Host: "unix:///a.sock"}, HideInjected: true},
+			src:      BindMountProxyConfig{DockerHost: &DockerHostConfig{Host: "unix:///b.sock"}},
+			expected: BindMountProxyConfig{DockerHost: &DockerHostConfig{Host: "unix:///b.sock"}, HideInjected: true},
+		},
+	}
+	for _, test := range tests {
+		dst := test.dst
+		dst.BindMounts = append([]ImageBindMountConfig(nil), test.dst.BindMounts...)
+		mergeConfig(&dst, &test.src)
+		if !reflect.DeepEqual(dst, test.expected) {
+			t.Errorf("%s: expected\n%#v\ngot\n%#v", test.name, test.expected, dst)
+		}
+	}
+}
+
+// writeConfigFiles writes the given files, by path relative to dir
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfigFileIncludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []string
+		disabled []string
+		sources  []string
+		err      string
+	}{
+		{
+			name: "include order",
+			files: map[string]string{
+				"main.yaml": "include: [base.json, conf.d]\nbindMounts:\n- {name: main, imagePattern: main}\n",
+				"base.json": `{"bindMounts": [{"name": "base", "imagePattern": "base"}]}`,
+				// Files of a directory are read in lexical order, and only
+				// configuration files are read
+				"conf.d/20-b.toml": "[[bindMounts]]\nname = \"b\"\nimagePattern = \"b\"\n",
+				"conf.d/10-a.yml":  "bindMounts:\n- {name: a, imagePattern: a}\n",
+				"conf.d/README":    "not a configuration",
+			},
+			expected: []string{"main", "base", "a", "b"},
+			sources:  []string{"main.yaml", "base.json", "conf.d", "conf.d/10-a.yml", "conf.d/20-b.toml"},
+		},
+		{
+			name: "override and disable by name",
+			files: map[string]string{
+				"main.yaml":  "include: [local.yaml]\nbindMounts:\n- {name: origin, imagePattern: origin}\n- {name: node, imagePattern: node}\n- {name: router, imagePattern: router}\n",
+				"local.yaml": "bindMounts:\n- {name: node, imagePattern: node-dev}\n- {name: router, disabled: true}\n",
+			},
+			expected: []string{"origin", "node-dev", "router"},
+			disabled: []string{"router"},
+			sources:  []string{"main.yaml", "local.yaml"},
+		},
+		{
+			name: "nested includes are relative to the including file",
+			files: map[string]string{
+				"main.yaml":     "include: [sub/one.yaml]\n",
+				"sub/one.yaml":  "include: [two.yaml]\nbindMounts:\n- {name: one, imagePattern: one}\n",
+				"sub/two.yaml":  "bindMounts:\n- {name: one, imagePattern: two}\n",
+				"sub/other.yml": "bindMounts:\n- {name: ignored, imagePattern: ignored}\n",
+			},
+			expected: []string{"two"},
+			sources:  []string{"main.yaml", "sub/one.yaml", "sub/two.yaml"},
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.yaml":  "include: [other.yaml]\n",
+				"other.yaml": "include: [main.yaml]\n",
+			},
+			err: "includes itself",
+		},
+		{
+			name:  "missing include",
+			files: map[string]string{"main.yaml": "include: [missing.yaml]\n"},
+			err:   "invalid include in",
+		},
+		{
+			name: "invalid included file",
+			files: map[string]string{
+				"main.yaml": "include: [bad.yaml]\n",
+				"bad.yaml":  "bindMounts:\n- {imagepattern: x}\n",
+			},
+			err: "bad.yaml",
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeConfigFiles(t, dir, test.files)
+
+		cfg, err := LoadConfigFile(filepath.Join(dir, "main.yaml"))
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var patterns, disabled []string
+		for _, r := range cfg.BindMounts {
+			patterns = append(patterns, r.ImagePattern)
+			if r.Disabled {
+				disabled = append(disabled, r.Name)
+			}
+		}
+		if !reflect.DeepEqual(patterns, test.expected) {
+			t.Errorf("%s: expected rules %v, got %v", test.name, test.expected, patterns)
+		}
+		if !reflect.DeepEqual(disabled, test.disabled) {
+			t.Errorf("%s: expected disabled rules %v, got %v", test.name, test.disabled, disabled)
+		}
+		var sources []string
+		for _, source := range cfg.Sources {
+			rel, _ := filepath.Rel(dir, source)
+			sources = append(sources, rel)
+		}
+		if !reflect.DeepEqual(sources, test.sources) {
+			t.Errorf("%s: expected sources %v, got %v", test.name, test.sources, sources)
+		}
+		if cfg.Include != nil {
+			t.Errorf("%s: expected includes to be resolved, got %v", test.name, cfg.Include)
+		}
+	}
+}
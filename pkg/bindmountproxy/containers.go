@@ -0,0 +1,196 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// ContainerInterceptor is the name of the interceptor that applies rules to
+// requests on existing containers
+const ContainerInterceptor = "container-rules"
+
+// Start verification modes
+const (
+	VerifyWarn = "warn"
+	VerifyFail = "fail"
+)
+
+// execEnvAPIVersion is the first Docker API version that accepts environment
+// variables for exec sessions
+var execEnvAPIVersion = dockerproxy.APIVersion{Major: 1, Minor: 25}
+
+// ExecConfig is applied to the exec sessions created in matching containers
+type ExecConfig struct {
+	// Env is added to the environment of exec sessions. It requires Docker
+	// API 1.25 or later.
+	Env []EnvConfig `json:"env,omitempty"`
+}
+
+// UpdateConfig is applied to the update requests of matching containers
+type UpdateConfig struct {
+	// Set maps fields of the update request, such as Memory or
+	// RestartPolicy, to the values they are set to, replacing those of the
+	// client
+	Set map[string]interface{} `json:"set,omitempty"`
+}
+
+// containerRequestModifier applies the rules to exec, update and start
+// requests. Rules are matched against the container the request is for, the
+// way they are matched against create requests.
+func containerRequestModifier(rules func() *RuleSet, images imageInspector, containers containerInspector, missingMounts *prometheus.CounterVec) dockerproxy.RequestModifierFunc {
+	return func(req *http.Request) (*http.Request, error) {
+		route := dockerproxy.RouteOf(req)
+		var applies func(r *rule) bool
+		switch route.Route {
+		case dockerproxy.RouteExecCreate:
+			applies = func(r *rule) bool { return r.Exec != nil && len(r.Exec.Env) > 0 }
+		case dockerproxy.RouteContainerUpdate:
+			applies = func(r *rule) bool { return r.Update != nil && len(r.Update.Set) > 0 }
+		case dockerproxy.RouteContainerStart:
+			applies = func(r *rule) bool { return len(r.VerifyOnStart) > 0 }
+		default:
+			return req, nil
+		}
+		var candidates []*rule
+		for _, r := range rules().rules {
+			if applies(r) {
+				candidates = append(candidates, r)
+			}
+		}
+		// The container is only inspected if a rule may apply to it
+		if len(candidates) == 0 {
+			return req, nil
+		}
+		container, err := containers.inspectContainer(route.Name)
+		if err != nil {
+			// The daemon reports missing containers to the client itself
+			glog.Warningf("Cannot apply rules to container %s: %v", route.Name, err)
+			return req, nil
+		}
+		matchReq := container.createRequest(route.Version, images)
+		var matched []*rule
+		for _, r := range candidates {
+			if ok, reason := r.match(matchReq); ok {
+				matched = append(matched, r)
+			} else {
+				glog.V(4).Infof("Rule %d does not apply to container %s: %s", r.index, route.Name, reason)
+			}
+		}
+		if len(matched) == 0 {
+			return req, nil
+		}
+		switch route.Route {
+		case dockerproxy.RouteExecCreate:
+			if !route.Version.IsZero() && route.Version.Compare(execEnvAPIVersion) < 0 {
+				glog.Warningf("Adding environment variables to an exec session with API version %s, which ignores them", route.Version)
+			}
+			return patchRequestBody(req, func(body *jsonObject) error {
+				return addExecEnv(body, matched)
+			})
+		case dockerproxy.RouteContainerUpdate:
+			return patchRequestBody(req, func(body *jsonObject) error {
+				return setUpdateFields(body, matched)
+			})
+		default:
+			return req, verifyMounts(container, route.Name, matched, missingMounts)
+		}
+	}
+}
+
+// addExecEnv adds the exec environment variables of the rules to the body of
+// an exec create request
+func addExecEnv(body *jsonObject, matched []*rule) error {
+	var env []string
+	if _, err := body.decode("Env", &env); err != nil {
+		return dockerproxy.BadRequest("invalid exec request: %v", err)
+	}
+	for _, r := range matched {
+		for _, v := range r.Exec.Env {
+			env = append(env, fmt.Sprintf("%s=%s", v.Name, v.Value))
+		}
+	}
+	return body.set("Env", env)
+}
+
+// setUpdateFields sets the update fields of the rules in the body of an update
+// request. Rules that come later override earlier ones.
+func setUpdateFields(body *jsonObject, matched []*rule) error {
+	for _, r := range matched {
+		fields := make([]string, 0, len(r.Update.Set))
+		for field := range r.Update.Set {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if err := body.set(field, r.Update.Set[field]); err != nil {
+				return fmt.Errorf("cannot set %s: %v", field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyMounts checks that a container being started has the mounts of the
+// rules that verify them. Containers created before a rule was added, or
+// while it was disabled, do not have its mounts.
+func verifyMounts(container *containerInfo, name string, matched []*rule, missingMounts *prometheus.CounterVec) error {
+	mounted := container.destinations()
+	var failed []string
+	for _, r := range matched {
+		var missing []string
+		for _, mount := range r.Mounts {
+			if !mounted[filepath.Clean(mount.Destination)] {
+				missing = append(missing, mount.Destination)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		missingMounts.WithLabelValues(r.label()).Inc()
+		glog.Warningf("Container %s does not have the mounts of rule %s at %s, it must be recreated to get them", name, r.label(), strings.Join(missing, ", "))
+		if r.VerifyOnStart == VerifyFail {
+			failed = append(failed, fmt.Sprintf("%s (%s)", r.label(), strings.Join(missing, ", ")))
+		}
+	}
+	if len(failed) > 0 {
+		return &dockerproxy.RequestError{
+			StatusCode: http.StatusConflict,
+			Err:        fmt.Errorf("container %s is missing the mounts of %s; recreate it to add them", name, strings.Join(failed, ", ")),
+		}
+	}
+	return nil
+}
+
+// patchRequestBody applies patch to the JSON object in the body of a request
+// and returns the request with the patched body. An empty body is patched as
+// an empty object.
+func patchRequestBody(req *http.Request, patch func(body *jsonObject) error) (*http.Request, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, dockerproxy.BadRequest("cannot read request: %v", err)
+	}
+	body := newJSONObject()
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err = json.Unmarshal(data, body); err != nil {
+			return nil, dockerproxy.BadRequest("invalid request body: %v", err)
+		}
+	}
+	if err = patch(body); err != nil {
+		return nil, err
+	}
+	if data, err = body.MarshalJSON(); err != nil {
+		return nil, err
+	}
+	return withBody(req, bytes.NewReader(data))
+}
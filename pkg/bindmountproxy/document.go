@@ -0,0 +1,238 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// strSlice is a list of strings that may also be given as a single string, as
+// the Cmd and Entrypoint of a container can
+type strSlice []string
+
+func (s *strSlice) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a string or a list of strings")
+	}
+	*s = strSlice{str}
+	return nil
+}
+
+// jsonObject is a JSON object that keeps the order of its keys and the raw
+// encoding of its values, so that it encodes to what it was decoded from
+// except for the fields that were changed
+type jsonObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: map[string]json.RawMessage{}}
+}
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected a JSON object")
+	}
+	o.keys = nil
+	o.values = map[string]json.RawMessage{}
+	for decoder.More() {
+		if token, err = decoder.Token(); err != nil {
+			return err
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return err
+		}
+		// Like encoding/json, the last of duplicate keys wins
+		if _, exists := o.values[key]; !exists {
+			o.keys = append(o.keys, key)
+		}
+		o.values[key] = value
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// key returns the key the object holds a field under. The daemon decodes
+// requests with encoding/json, so an exact match is preferred and names are
+// otherwise matched case-insensitively.
+func (o *jsonObject) key(field string) (string, bool) {
+	if _, ok := o.values[field]; ok {
+		return field, true
+	}
+	for _, key := range o.keys {
+		if strings.EqualFold(key, field) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// decode decodes a field into value. It returns false if the field is
+// missing or null.
+func (o *jsonObject) decode(field string, value interface{}) (bool, error) {
+	key, ok := o.key(field)
+	if !ok || string(o.values[key]) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(o.values[key], value); err != nil {
+		return false, fmt.Errorf("invalid %s: %v", field, err)
+	}
+	return true, nil
+}
+
+// set replaces a field with the encoding of value, keeping its position. A
+// new field is added at the end.
+func (o *jsonObject) set(field string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	key, ok := o.key(field)
+	if !ok {
+		key = field
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = data
+	return nil
+}
+
+// remove deletes a field
+func (o *jsonObject) remove(field string) {
+	key, ok := o.key(field)
+	if !ok {
+		return
+	}
+	delete(o.values, key)
+	for i := range o.keys {
+		if o.keys[i] == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// createDocument is the body of a container create request. The proxy only
+// changes the image and the fields it adds mounts and environment variables
+// to; everything else, including fields of API versions the proxy does not
+// know about, is sent to the daemon the way the client sent it.
+type createDocument struct {
+	body []byte
+	root *jsonObject
+	// hostConfig is the HostConfig of the request, or nil if it has none
+	hostConfig *jsonObject
+	changed    bool
+}
+
+func parseCreateDocument(body []byte) (*createDocument, error) {
+	doc := &createDocument{body: body, root: newJSONObject()}
+	if err := json.Unmarshal(body, doc.root); err != nil {
+		return nil, err
+	}
+	hc := newJSONObject()
+	ok, err := doc.root.decode("HostConfig", hc)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		doc.hostConfig = hc
+	}
+	return doc, nil
+}
+
+// containerData returns the fields of the request that rules are matched
+// against. Fields that cannot be decoded are matched as if they were missing,
+// and left for the daemon to report.
+func (d *createDocument) containerData() *createContainerData {
+	data := &createContainerData{}
+	fields := []struct {
+		name  string
+		value interface{}
+	}{
+		{"Image", &data.Image},
+		{"Labels", &data.Labels},
+		{"Env", &data.Env},
+		{"Cmd", &data.Cmd},
+		{"Entrypoint", &data.Entrypoint},
+	}
+	for _, field := range fields {
+		if _, err := d.root.decode(field.name, field.value); err != nil {
+			glog.V(2).Infof("Matching the container create request without %s: %v", field.name, err)
+		}
+	}
+	return data
+}
+
+// encode returns the body to send to the daemon, which is the body of the
+// client if nothing was changed
+func (d *createDocument) encode() ([]byte, error) {
+	if !d.changed {
+		return d.body, nil
+	}
+	if d.hostConfig != nil {
+		if err := d.root.set("HostConfig", d.hostConfig); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(d.root)
+}
+
+// ensureHostConfig returns the HostConfig of the request, adding an empty one
+// if the client omitted it
+func (d *createDocument) ensureHostConfig() *jsonObject {
+	if d.hostConfig == nil {
+		d.hostConfig = newJSONObject()
+	}
+	return d.hostConfig
+}
+
+// setImage replaces the image the container is created from
+func (d *createDocument) setImage(image string) error {
+	d.changed = true
+	return d.root.set("Image", image)
+}
+
+// appendEnv adds NAME=value environment variables after those of the client
+func (d *createDocument) appendEnv(vars ...string) error {
+	var env []string
+	if _, err := d.root.decode("Env", &env); err != nil {
+		return err
+	}
+	d.changed = true
+	return d.root.set("Env", append(env, vars...))
+}
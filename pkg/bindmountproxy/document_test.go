@@ -0,0 +1,226 @@
+package bindmountproxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONObjectRoundTrip(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`{"Zeta":1,"Alpha":2}`,
+		`{"Big":9007199254740993,"Float":1.50,"Nested":{"b":[1,2,{"c":null}],"a":"x"}}`,
+		`{"Image":"foo","NetworkingConfig":{"EndpointsConfig":{}},"FutureField":{"Unknown":true}}`,
+	}
+	for _, test := range tests {
+		o := newJSONObject()
+		if err := json.Unmarshal([]byte(test), o); err != nil {
+			t.Errorf("%s: unexpected error: %v", test, err)
+			continue
+		}
+		data, err := json.Marshal(o)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test, err)
+			continue
+		}
+		if string(data) != test {
+			t.Errorf("expected %s, got %s", test, data)
+		}
+	}
+	for _, invalid := range []string{`[]`, `"x"`, `{"a":}`, `{"a":1`} {
+		if err := json.Unmarshal([]byte(invalid), newJSONObject()); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestJSONObjectFields(t *testing.T) {
+	o := newJSONObject()
+	if err := json.Unmarshal([]byte(`{"b":1,"image":"foo","Env":null,"a":2}`), o); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var image string
+	if ok, err := o.decode("Image", &image); !ok || err != nil || image != "foo" {
+		t.Errorf("expected a case-insensitive match of Image, got %q, %t, %v", image, ok, err)
+	}
+	var env []string
+	if ok, err := o.decode("Env", &env); ok || err != nil {
+		t.Errorf("expected a null field to be missing, got %t, %v", ok, err)
+	}
+	if ok, err := o.decode("Missing", &env); ok || err != nil {
+		t.Errorf("expected a missing field, got %t, %v", ok, err)
+	}
+	var number int
+	if _, err := o.decode("image", &number); err == nil {
+		t.Errorf("expected an error decoding a string into a number")
+	}
+
+	// Existing fields keep their position and their key, new ones are added
+	// at the end
+	if err := o.set("Image", "bar"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.set("Env", []string{"A=1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.set("New", true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.remove("b")
+	o.remove("missing")
+	expected := `{"image":"bar","Env":["A=1"],"a":2,"New":true}`
+	if data, _ := json.Marshal(o); string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestCreateDocumentUnchanged(t *testing.T) {
+	body := `{ "Image" : "foo",  "HostConfig": {"Memory": 9007199254740993} }`
+	doc, err := parseCreateDocument([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := doc.encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != body {
+		t.Errorf("expected the body of the client, got %s", data)
+	}
+}
+
+func TestCreateDocumentPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		patch    func(doc *createDocument) error
+		expected string
+	}{
+		{
+			name: "bind with unknown fields",
+			body: `{"Zeta":1,"Image":"foo","HostConfig":{"Memory":9007199254740993,"Binds":["/a:/a"],"Future":{}},"Alpha":2}`,
+			patch: func(doc *createDocument) error {
+				return doc.addMount(MountStyleBinds, BindMountConfig{Source: "/src", Destination: "/dst"})
+			},
+			expected: `{"Zeta":1,"Image":"foo","HostConfig":{"Memory":9007199254740993,"Binds":["/a:/a","/src:/dst:z"],"Future":{}},"Alpha":2}`,
+		},
+		{
+			name: "null HostConfig",
+			body: `{"Image":"foo","HostConfig":null,"Cmd":["x"]}`,
+			patch: func(doc *createDocument) error {
+				return doc.addMount(MountStyleBinds, BindMountConfig{Source: "/src", Destination: "/dst", SELinuxLabel: SELinuxLabelNone})
+			},
+			expected: `{"Image":"foo","HostConfig":{"Binds":["/src:/dst"]},"Cmd":["x"]}`,
+		},
+		{
+			name: "missing HostConfig",
+			body: `{"Image":"foo"}`,
+			patch: func(doc *createDocument) error {
+				return doc.addMount(MountStyleMounts, BindMountConfig{Type: MountTypeTmpfs, Destination: "/tmp", TmpfsSize: 1024})
+			},
+			expected: `{"Image":"foo","HostConfig":{"Mounts":[{"Type":"tmpfs","Target":"/tmp","TmpfsOptions":{"SizeBytes":1024}}]}}`,
+		},
+		{
+			name: "lowercase keys",
+			body: `{"image":"foo","env":["A=1"],"hostconfig":{"tmpfs":{"/run":""}}}`,
+			patch: func(doc *createDocument) error {
+				if err := doc.addMount(MountStyleBinds, BindMountConfig{Type: MountTypeTmpfs, Destination: "/tmp"}); err != nil {
+					return err
+				}
+				return doc.appendEnv("B=2")
+			},
+			expected: `{"image":"foo","env":["A=1","B=2"],"hostconfig":{"tmpfs":{"/run":"","/tmp":""}}}`,
+		},
+		{
+			name: "unmount volume and tmpfs",
+			body: `{"Image":"foo","Volumes":{"/data/":{},"/keep":{}},"HostConfig":{"Tmpfs":{"/data":"size=1","/run":""}}}`,
+			patch: func(doc *createDocument) error {
+				return doc.unmount("/data")
+			},
+			expected: `{"Image":"foo","Volumes":{"/keep":{}},"HostConfig":{"Tmpfs":{"/run":""}}}`,
+		},
+		{
+			name: "unmount binds and mounts",
+			body: `{"HostConfig":{"Binds":["/a:/data:ro","/b:/b"],"Mounts":[{"Target":"/data","Type":"volume","Source":"v"},{"Target":"/c","Type":"tmpfs"}]}}`,
+			patch: func(doc *createDocument) error {
+				return doc.unmount("/data")
+			},
+			expected: `{"HostConfig":{"Binds":["/b:/b"],"Mounts":[{"Target":"/c","Type":"tmpfs"}]}}`,
+		},
+		{
+			name: "replace image",
+			body: `{"Image":"foo","Cmd":"echo"}`,
+			patch: func(doc *createDocument) error {
+				return doc.setImage("bar")
+			},
+			expected: `{"Image":"bar","Cmd":"echo"}`,
+		},
+	}
+	for _, test := range tests {
+		doc, err := parseCreateDocument([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if err = test.patch(doc); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		data, err := doc.encode()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, data)
+		}
+	}
+}
+
+func TestCreateDocumentIsMounted(t *testing.T) {
+	doc, err := parseCreateDocument([]byte(`{"Volumes":{"/vol/":{}},"HostConfig":{"Binds":["/a:/bind:ro","/anon"],"Mounts":[{"Target":"/mount"}],"Tmpfs":{"/tmpfs":""}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, destination := range []string{"/vol", "/bind", "/anon", "/mount/", "/tmpfs"} {
+		if ok, err := doc.isMounted(destination); !ok || err != nil {
+			t.Errorf("expected %s to be mounted, got %t, %v", destination, ok, err)
+		}
+	}
+	if ok, err := doc.isMounted("/a"); ok || err != nil {
+		t.Errorf("expected /a not to be mounted, got %t, %v", ok, err)
+	}
+}
+
+func TestCreateDocumentContainerData(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected createContainerData
+	}{
+		{
+			body:     `{"Image":"foo","Cmd":"echo hi","Entrypoint":"/bin/sh"}`,
+			expected: createContainerData{Image: "foo", Cmd: strSlice{"echo hi"}, Entrypoint: strSlice{"/bin/sh"}},
+		},
+		{
+			body:     `{"image":"foo","cmd":["echo","hi"],"Entrypoint":[],"Labels":{"a":"b"},"Env":["A=1"]}`,
+			expected: createContainerData{Image: "foo", Cmd: strSlice{"echo", "hi"}, Entrypoint: strSlice{}, Labels: map[string]string{"a": "b"}, Env: []string{"A=1"}},
+		},
+		{
+			// Fields that cannot be decoded are left for the daemon to report
+			body:     `{"Image":"foo","Labels":5,"Cmd":{"a":1},"Env":null}`,
+			expected: createContainerData{Image: "foo"},
+		},
+	}
+	for _, test := range tests {
+		doc, err := parseCreateDocument([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.body, err)
+			continue
+		}
+		if data := doc.containerData(); !reflect.DeepEqual(*data, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.body, test.expected, *data)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package bindmountproxy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// RuleResult is the outcome of matching a rule against a container create
+// request
+type RuleResult struct {
+	// Index is the position of the rule in the configuration's bindMounts
+	Index  int
+	Name   string
+	Source string
+	// Disabled rules are not matched
+	Disabled bool
+	Matched  bool
+	// Reason explains why a rule that is not disabled did not match
+	Reason string
+
+	// label identifies the rule in logs and metrics
+	label string
+}
+
+func (r *rule) result(matched bool, reason string) RuleResult {
+	return RuleResult{
+		Index:   r.index,
+		Name:    r.Name,
+		Source:  r.source,
+		Matched: matched,
+		Reason:  reason,
+		label:   r.label(),
+	}
+}
+
+// label returns the name of the rule, or its position in the configuration if
+// it does not have a name
+func (r *rule) label() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	return fmt.Sprintf("bindMounts[%d]", r.index)
+}
+
+// Explanation describes what the proxy does with a container create request
+type Explanation struct {
+	// Rules holds the result of every rule in the configuration, in order
+	Rules []RuleResult
+	// Body is the create request that is sent to the daemon. It is empty if
+	// the request is rejected.
+	Body []byte
+}
+
+// Explain applies the rule set to the body of a container create request made
+// with the given API version the way the proxy does, without sending it to a
+// daemon. If the version is zero, rules with API version bounds do not match.
+//
+// Images are inspected through the backend when a rule needs their details; if
+// backend is nil, rules are matched without them. If the proxy would reject
+// the request, the error is returned along with the explanation of the rules
+// that were matched.
+func (r *RuleSet) Explain(body []byte, containerName string, version dockerproxy.APIVersion, backend *dockerproxy.Backend) (*Explanation, error) {
+	var images imageInspector
+	if backend != nil {
+		images = newDaemonClient(backend)
+	}
+	rewrite, err := rewriteCreate(r, body, containerName, version, images)
+	results := rewrite.rules
+	for i, cfg := range r.config.BindMounts {
+		if cfg.Disabled {
+			results = append(results, RuleResult{Index: i, Name: cfg.Name, Source: cfg.source, Disabled: true})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	return &Explanation{Rules: results, Body: rewrite.body}, err
+}
@@ -0,0 +1,299 @@
+package bindmountproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// maxInjections is the number of containers whose injected mounts and
+// environment are remembered. The oldest containers are forgotten first.
+const maxInjections = 10000
+
+// injection is what the proxy added to a container when it was created
+type injection struct {
+	// destinations are the container paths of the mounts that were added
+	destinations map[string]bool
+	// env holds the NAME=value environment variables that were added
+	env []string
+	// image is the image the client asked for, and replacedImage the image
+	// the container was created from instead, if a rule replaced it
+	image         string
+	replacedImage string
+}
+
+func newInjection(rewrite *createRewrite) *injection {
+	inj := &injection{
+		destinations:  map[string]bool{},
+		env:           rewrite.env,
+		image:         rewrite.image,
+		replacedImage: rewrite.replacedImage,
+	}
+	for _, mount := range rewrite.mounts {
+		inj.destinations[filepath.Clean(mount.Destination)] = true
+	}
+	return inj
+}
+
+// injectionStore remembers the injections of containers by container ID
+type injectionStore struct {
+	lock  sync.Mutex
+	byID  map[string]*injection
+	order []string
+}
+
+func newInjectionStore() *injectionStore {
+	return &injectionStore{byID: map[string]*injection{}}
+}
+
+func (s *injectionStore) add(id string, inj *injection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.byID[id]; !exists {
+		s.order = append(s.order, id)
+	}
+	s.byID[id] = inj
+	for len(s.order) > maxInjections {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *injectionStore) get(id string) *injection {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.byID[id]
+}
+
+type createRewriteKey struct{}
+
+// bindMountResponseModifier counts the rules applied to the containers created
+// through the proxy, remembers what was injected into them and, when the
+// active configuration has hideInjected set, removes it from their inspect
+// output
+func bindMountResponseModifier(rules func() *RuleSet, injections *injectionStore, ruleMatches *prometheus.CounterVec) dockerproxy.ResponseModifierFunc {
+	return func(resp *http.Response, req *http.Request) error {
+		if rewrite, ok := resp.Request.Context().Value(createRewriteKey{}).(*createRewrite); ok {
+			if resp.StatusCode != http.StatusCreated {
+				return nil
+			}
+			for _, result := range rewrite.rules {
+				if result.Matched {
+					ruleMatches.WithLabelValues(result.label).Inc()
+				}
+			}
+			if !rules().Config().HideInjected || (len(rewrite.mounts) == 0 && len(rewrite.env) == 0 && len(rewrite.replacedImage) == 0) {
+				return nil
+			}
+			body, err := readResponseBody(resp)
+			if err != nil {
+				return err
+			}
+			created := struct {
+				ID string `json:"Id"`
+			}{}
+			if err = json.Unmarshal(body, &created); err != nil || len(created.ID) == 0 {
+				glog.Warningf("Cannot read the ID of the created container, its injected settings will be visible: %v", err)
+				return nil
+			}
+			injections.add(created.ID, newInjection(rewrite))
+			return nil
+		}
+		if rules().Config().HideInjected && resp.StatusCode == http.StatusOK && dockerproxy.RouteOf(req).Route == dockerproxy.RouteContainerInspect {
+			return hideInjected(resp, injections)
+		}
+		return nil
+	}
+}
+
+// readResponseBody reads the body of a response and puts it back, so that it
+// is still returned to the client
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	dockerproxy.SetResponseBody(resp, body)
+	return body, nil
+}
+
+// hideInjected removes the injected mounts and environment of a container
+// from its inspect output, and shows the image the client asked for. Only
+// those fields are changed; the rest of the output is returned the way the
+// daemon sent it.
+func hideInjected(resp *http.Response, injections *injectionStore) error {
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return err
+	}
+	container := newJSONObject()
+	if err = json.Unmarshal(body, container); err != nil {
+		glog.Warningf("Cannot decode container inspect output: %v", err)
+		return nil
+	}
+	var id string
+	if _, err = container.decode("Id", &id); err != nil {
+		glog.Warningf("Cannot decode container inspect output: %v", err)
+		return nil
+	}
+	inj := injections.get(id)
+	if inj == nil {
+		return nil
+	}
+	if err = inj.strip(container); err != nil {
+		glog.Warningf("Cannot hide the injected settings of container %s: %v", id, err)
+		return nil
+	}
+	if body, err = container.MarshalJSON(); err != nil {
+		return err
+	}
+	dockerproxy.SetResponseBody(resp, body)
+	return nil
+}
+
+// strip removes the injected settings from a decoded container
+func (inj *injection) strip(container *jsonObject) error {
+	config := newJSONObject()
+	if ok, err := container.decode("Config", config); err != nil {
+		return err
+	} else if ok {
+		if err = inj.stripConfig(config); err != nil {
+			return err
+		}
+		if err = container.set("Config", config); err != nil {
+			return err
+		}
+	}
+	hc := newJSONObject()
+	if ok, err := container.decode("HostConfig", hc); err != nil {
+		return err
+	} else if ok {
+		if err = inj.stripHostConfig(hc); err != nil {
+			return err
+		}
+		if err = container.set("HostConfig", hc); err != nil {
+			return err
+		}
+	}
+	return inj.stripList(container, "Mounts", func(item json.RawMessage) string {
+		return rawString(item, "Destination")
+	})
+}
+
+// stripConfig removes the injected environment from the Config of a container
+// and restores the image the client asked for
+func (inj *injection) stripConfig(config *jsonObject) error {
+	var env []string
+	if ok, err := config.decode("Env", &env); err != nil {
+		return err
+	} else if ok && len(inj.env) > 0 {
+		if err = config.set("Env", inj.stripEnv(env)); err != nil {
+			return err
+		}
+	}
+	if len(inj.replacedImage) == 0 {
+		return nil
+	}
+	var image string
+	if _, err := config.decode("Image", &image); err != nil {
+		return err
+	}
+	if image == inj.replacedImage {
+		return config.set("Image", inj.image)
+	}
+	return nil
+}
+
+// stripHostConfig removes the injected mounts from the HostConfig of a
+// container
+func (inj *injection) stripHostConfig(hc *jsonObject) error {
+	err := inj.stripList(hc, "Binds", func(item json.RawMessage) string {
+		var bind string
+		json.Unmarshal(item, &bind)
+		return bindTarget(bind)
+	})
+	if err != nil {
+		return err
+	}
+	err = inj.stripList(hc, "Mounts", func(item json.RawMessage) string {
+		return rawString(item, "Target")
+	})
+	if err != nil {
+		return err
+	}
+	tmpfs := newJSONObject()
+	ok, err := hc.decode("Tmpfs", tmpfs)
+	if err != nil || !ok {
+		return err
+	}
+	for _, target := range append([]string{}, tmpfs.keys...) {
+		if inj.destinations[filepath.Clean(target)] {
+			tmpfs.remove(target)
+		}
+	}
+	// The daemon omits Tmpfs when there are no tmpfs mounts
+	if len(tmpfs.keys) == 0 {
+		hc.remove("Tmpfs")
+		return nil
+	}
+	return hc.set("Tmpfs", tmpfs)
+}
+
+// stripList removes the items whose destination is an injected mount from the
+// list in the given field of an object. Lists that end up empty become null,
+// the way the daemon reports lists it was not given.
+func (inj *injection) stripList(object *jsonObject, field string, destination func(json.RawMessage) string) error {
+	var items []json.RawMessage
+	ok, err := object.decode(field, &items)
+	if err != nil || !ok {
+		return err
+	}
+	var kept []json.RawMessage
+	for _, item := range items {
+		if !inj.destinations[filepath.Clean(destination(item))] {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == len(items) {
+		return nil
+	}
+	return object.set(field, kept)
+}
+
+// stripEnv removes the injected variables from an environment. The last
+// occurrence of each is removed, since injected variables are appended after
+// those of the client. An environment that ends up empty is nil, like the lists
+// stripped by stripList.
+func (inj *injection) stripEnv(env []string) []string {
+	for i := len(inj.env) - 1; i >= 0; i-- {
+		for j := len(env) - 1; j >= 0; j-- {
+			if env[j] == inj.env[i] {
+				env = append(env[:j], env[j+1:]...)
+				break
+			}
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return env
+}
+
+// rawString returns a string field of an encoded object, or an empty string
+// if it does not have one
+func rawString(item json.RawMessage, field string) string {
+	object := newJSONObject()
+	if err := json.Unmarshal(item, object); err != nil {
+		return ""
+	}
+	var s string
+	object.decode(field, &s)
+	return s
+}
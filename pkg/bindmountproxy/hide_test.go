@@ -0,0 +1,149 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func inspectResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+func TestHideInjected(t *testing.T) {
+	injected := &injection{
+		destinations: map[string]bool{"/usr/bin/openshift": true, "/tmp": true, "/data": true},
+		env:          []string{"A=injected", "B=2"},
+	}
+	replaced := &injection{
+		destinations:  map[string]bool{},
+		image:         "openshift/origin:v3.6",
+		replacedImage: "openshift/origin:dev",
+	}
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "unknown fields and key order are kept",
+			body:     `{"Zeta":9007199254740993,"Id":"injected","Config":{"Image":"foo","Env":["A=client","A=injected","B=2"],"Future":1.50},"HostConfig":{"Binds":["/a:/a","/src:/usr/bin/openshift:z"],"Memory":9007199254740993},"Alpha":{}}`,
+			expected: `{"Zeta":9007199254740993,"Id":"injected","Config":{"Image":"foo","Env":["A=client"],"Future":1.50},"HostConfig":{"Binds":["/a:/a"],"Memory":9007199254740993},"Alpha":{}}`,
+		},
+		{
+			name:     "mounts and tmpfs",
+			body:     `{"Id":"injected","HostConfig":{"Mounts":[{"Type":"bind","Target":"/data"},{"Type":"volume","Target":"/keep"}],"Tmpfs":{"/tmp":""}},"Mounts":[{"Type":"bind","Destination":"/usr/bin/openshift/"},{"Type":"bind","Destination":"/data"}]}`,
+			expected: `{"Id":"injected","HostConfig":{"Mounts":[{"Type":"volume","Target":"/keep"}]},"Mounts":null}`,
+		},
+		{
+			name:     "nothing injected in the output",
+			body:     `{"Id":"injected","Config":{"Env":null},"HostConfig":{"Binds":null},"Mounts":[]}`,
+			expected: `{"Id":"injected","Config":{"Env":null},"HostConfig":{"Binds":null},"Mounts":[]}`,
+		},
+		{
+			name:     "replaced image",
+			body:     `{"Id":"replaced","Image":"sha256:abc","Config":{"Image":"openshift/origin:dev"}}`,
+			expected: `{"Id":"replaced","Image":"sha256:abc","Config":{"Image":"openshift/origin:v3.6"}}`,
+		},
+		{
+			name:     "other container",
+			body:     `{ "Id": "other", "Config": {"Env": ["A=injected"]} }`,
+			expected: `{ "Id": "other", "Config": {"Env": ["A=injected"]} }`,
+		},
+		{
+			name:     "not a container",
+			body:     `[1, 2]`,
+			expected: `[1, 2]`,
+		},
+	}
+	for _, test := range tests {
+		injections := newInjectionStore()
+		injections.add("injected", injected)
+		injections.add("replaced", replaced)
+		resp := inspectResponse(test.body)
+		if err := hideInjected(resp, injections); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, body)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s: expected a content length of %d, got %d", test.name, len(body), resp.ContentLength)
+		}
+	}
+}
+
+func TestBindMountResponseModifierHidesCreated(t *testing.T) {
+	rules, err := NewRuleSet(&BindMountProxyConfig{HideInjected: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	injections := newInjectionStore()
+	matches := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rule_matches_total"}, []string{"rule"})
+	modify := bindMountResponseModifier(func() *RuleSet { return rules }, injections, matches)
+
+	rewrite := &createRewrite{
+		image:  "foo",
+		mounts: []BindMountConfig{{Source: "/src", Destination: "/dst/"}},
+		env:    []string{"A=1"},
+	}
+	for _, create := range []struct {
+		id     string
+		status int
+	}{
+		{"rejected", http.StatusConflict},
+		{"created", http.StatusCreated},
+	} {
+		req, err := http.NewRequest("POST", "http://docker/v1.24/containers/create", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), createRewriteKey{}, rewrite))
+		resp := inspectResponse(`{"Id":"` + create.id + `","Warnings":null}`)
+		resp.StatusCode = create.status
+		resp.Request = req
+		if err = modify(resp, req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"created", `{"Id":"created","Config":{"Env":null},"HostConfig":{"Binds":null}}`},
+		// The daemon did not create the container, so nothing is remembered
+		{"rejected", `{"Id":"rejected","Config":{"Env":["A=1"]},"HostConfig":{"Binds":["/src:/dst"]}}`},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://docker/v1.24/containers/"+test.id+"/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := inspectResponse(`{"Id":"` + test.id + `","Config":{"Env":["A=1"]},"HostConfig":{"Binds":["/src:/dst"]}}`)
+		resp.Request = req
+		if err = modify(resp, req); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.id, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.id, test.expected, body)
+		}
+	}
+}
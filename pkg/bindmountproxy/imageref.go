@@ -0,0 +1,192 @@
+package bindmountproxy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	defaultRegistry     = "docker.io"
+	legacyRegistry      = "index.docker.io"
+	officialRepoPrefix  = "library/"
+	defaultTag          = "latest"
+	digestSeparator     = "@"
+	registrySeparator   = "/"
+	tagSeparator        = ":"
+	localhostRegistry   = "localhost"
+	maxRepositoryLength = 255
+)
+
+// ImageMatchConfig matches the image of a container by its normalized
+// reference. Registry, Repository and Tag are shell patterns as accepted by
+// path.Match; fields that are empty match anything.
+type ImageMatchConfig struct {
+	// Registry is the registry host the image is pulled from. Images without
+	// a registry are normalized to docker.io.
+	Registry string `json:"registry,omitempty"`
+	// Repository is the repository path, such as openshift/origin. Official
+	// Docker Hub images match both with and without the library/ prefix.
+	Repository string `json:"repository,omitempty"`
+	// Tag is the image tag. References without a tag or digest are
+	// normalized to the latest tag.
+	Tag string `json:"tag,omitempty"`
+	// Digest is the digest (sha256:...) the image was referenced by
+	Digest string `json:"digest,omitempty"`
+}
+
+// imageReference is an image reference normalized the way Docker does
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImageReference normalizes an image reference, so that openshift/origin,
+// docker.io/openshift/origin:latest and index.docker.io/openshift/origin all
+// result in the same registry, repository and tag
+func parseImageReference(ref string) (*imageReference, error) {
+	if len(ref) == 0 {
+		return nil, fmt.Errorf("empty image reference")
+	}
+	parsed := &imageReference{}
+	name := ref
+	if i := strings.Index(name, digestSeparator); i >= 0 {
+		name, parsed.digest = name[:i], name[i+1:]
+		if !digestPattern.MatchString(parsed.digest) {
+			return nil, fmt.Errorf("invalid digest in image reference %q", ref)
+		}
+	}
+	// A tag follows the last colon, unless that colon is part of a registry
+	// host:port, in which case a slash follows it
+	if i := strings.LastIndex(name, tagSeparator); i >= 0 && !strings.Contains(name[i+1:], registrySeparator) {
+		name, parsed.tag = name[:i], name[i+1:]
+		if len(parsed.tag) == 0 {
+			return nil, fmt.Errorf("empty tag in image reference %q", ref)
+		}
+	}
+
+	parsed.registry, parsed.repository = defaultRegistry, name
+	if i := strings.Index(name, registrySeparator); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == localhostRegistry {
+			parsed.registry, parsed.repository = first, name[i+1:]
+		}
+	}
+	if parsed.registry == legacyRegistry {
+		parsed.registry = defaultRegistry
+	}
+	if parsed.registry == defaultRegistry && !strings.Contains(parsed.repository, registrySeparator) {
+		parsed.repository = officialRepoPrefix + parsed.repository
+	}
+	if len(parsed.repository) == 0 || len(parsed.repository) > maxRepositoryLength ||
+		parsed.repository != strings.ToLower(parsed.repository) {
+		return nil, fmt.Errorf("invalid repository name in image reference %q", ref)
+	}
+	if len(parsed.tag) == 0 && len(parsed.digest) == 0 {
+		parsed.tag = defaultTag
+	}
+	return parsed, nil
+}
+
+// familiarRepository returns the repository the way Docker displays it,
+// without the library/ prefix of official images
+func (ref *imageReference) familiarRepository() string {
+	if ref.registry == defaultRegistry {
+		return strings.TrimPrefix(ref.repository, officialRepoPrefix)
+	}
+	return ref.repository
+}
+
+func (ref *imageReference) String() string {
+	s := ref.registry + registrySeparator + ref.repository
+	if len(ref.tag) > 0 {
+		s += tagSeparator + ref.tag
+	}
+	if len(ref.digest) > 0 {
+		s += digestSeparator + ref.digest
+	}
+	return s
+}
+
+// joinImageReference returns the reference of an image pulled with the given
+// fromImage and tag parameters. The tag may also be a digest.
+func joinImageReference(name, tag string) string {
+	switch {
+	case len(tag) == 0:
+		return name
+	case digestPattern.MatchString(tag):
+		return name + digestSeparator + tag
+	}
+	return name + tagSeparator + tag
+}
+
+// splitImageReference splits an image reference into the fromImage and tag
+// parameters of a pull. References without a tag are pulled with the latest
+// tag, rather than with every tag.
+func splitImageReference(ref string) (string, string) {
+	if i := strings.Index(ref, digestSeparator); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	if i := strings.LastIndex(ref, tagSeparator); i >= 0 && !strings.Contains(ref[i+1:], registrySeparator) {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, defaultTag
+}
+
+// validateImageMatch checks that the patterns of an image matcher are valid
+func validateImageMatch(match *ImageMatchConfig, invalid func(field, format string, args ...interface{})) {
+	patterns := []struct{ field, pattern string }{
+		{"image.registry", match.Registry},
+		{"image.repository", match.Repository},
+		{"image.tag", match.Tag},
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p.pattern, ""); err != nil {
+			invalid(p.field, "invalid pattern %q: %v", p.pattern, err)
+		}
+	}
+	if len(match.Digest) > 0 && !digestPattern.MatchString(match.Digest) {
+		invalid("image.digest", "%q is not a valid digest, expected algorithm:hex", match.Digest)
+	}
+	if *match == (ImageMatchConfig{}) {
+		invalid("image", "at least one of registry, repository, tag or digest is required")
+	}
+}
+
+// matchImage returns whether the image reference matches the image matcher
+// and, if it does not, the reason why
+func matchImage(match *ImageMatchConfig, image string) (bool, string) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return false, err.Error()
+	}
+	if len(match.Registry) > 0 {
+		registry := match.Registry
+		if registry == legacyRegistry {
+			registry = defaultRegistry
+		}
+		if ok, _ := path.Match(registry, ref.registry); !ok {
+			return false, fmt.Sprintf("registry %q does not match %q", ref.registry, match.Registry)
+		}
+	}
+	if len(match.Repository) > 0 {
+		ok, _ := path.Match(match.Repository, ref.repository)
+		if !ok {
+			ok, _ = path.Match(match.Repository, ref.familiarRepository())
+		}
+		if !ok {
+			return false, fmt.Sprintf("repository %q does not match %q", ref.familiarRepository(), match.Repository)
+		}
+	}
+	if len(match.Tag) > 0 {
+		if ok, _ := path.Match(match.Tag, ref.tag); !ok {
+			return false, fmt.Sprintf("tag %q does not match %q", ref.tag, match.Tag)
+		}
+	}
+	if len(match.Digest) > 0 && ref.digest != match.Digest {
+		return false, fmt.Sprintf("image %q is not referenced by digest %s", image, match.Digest)
+	}
+	return true, ""
+}
@@ -0,0 +1,109 @@
+package bindmountproxy
+
+import (
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected string
+		familiar string
+		err      bool
+	}{
+		{ref: "openshift/origin", expected: "docker.io/openshift/origin:latest", familiar: "openshift/origin"},
+		{ref: "openshift/origin:v3.6", expected: "docker.io/openshift/origin:v3.6", familiar: "openshift/origin"},
+		{ref: "docker.io/openshift/origin:v3.6", expected: "docker.io/openshift/origin:v3.6", familiar: "openshift/origin"},
+		{ref: "index.docker.io/openshift/origin", expected: "docker.io/openshift/origin:latest", familiar: "openshift/origin"},
+		{ref: "busybox", expected: "docker.io/library/busybox:latest", familiar: "busybox"},
+		{ref: "library/busybox:1.26", expected: "docker.io/library/busybox:1.26", familiar: "busybox"},
+		{ref: "docker.io/library/busybox", expected: "docker.io/library/busybox:latest", familiar: "busybox"},
+		{ref: "registry.local:5000/origin:v3.6", expected: "registry.local:5000/origin:v3.6", familiar: "origin"},
+		{ref: "registry.local:5000/openshift/origin", expected: "registry.local:5000/openshift/origin:latest", familiar: "openshift/origin"},
+		{ref: "localhost/origin", expected: "localhost/origin:latest", familiar: "origin"},
+		{ref: "openshift/origin@" + testDigest, expected: "docker.io/openshift/origin@" + testDigest, familiar: "openshift/origin"},
+		{ref: "openshift/origin:v3.6@" + testDigest, expected: "docker.io/openshift/origin:v3.6@" + testDigest, familiar: "openshift/origin"},
+		{ref: "registry.local:5000/origin@" + testDigest, expected: "registry.local:5000/origin@" + testDigest, familiar: "origin"},
+		{ref: "", err: true},
+		{ref: "openshift/origin:", err: true},
+		{ref: "OpenShift/origin", err: true},
+		{ref: "openshift/origin@sha256:xyz", err: true},
+	}
+	for _, test := range tests {
+		ref, err := parseImageReference(test.ref)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.ref, ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.ref, err)
+			continue
+		}
+		if ref.String() != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.ref, test.expected, ref)
+		}
+		if ref.familiarRepository() != test.familiar {
+			t.Errorf("%q: expected familiar repository %s, got %s", test.ref, test.familiar, ref.familiarRepository())
+		}
+	}
+}
+
+func TestMatchImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		match ImageMatchConfig
+		image string
+		ok    bool
+	}{
+		{name: "short name", match: ImageMatchConfig{Repository: "openshift/origin"}, image: "openshift/origin", ok: true},
+		{name: "qualified name", match: ImageMatchConfig{Repository: "openshift/origin"}, image: "docker.io/openshift/origin:v3.6", ok: true},
+		{name: "digest reference", match: ImageMatchConfig{Repository: "openshift/origin"}, image: "openshift/origin@" + testDigest, ok: true},
+		{name: "other repository", match: ImageMatchConfig{Repository: "openshift/origin"}, image: "openshift/origin-node", ok: false},
+		{name: "repository pattern", match: ImageMatchConfig{Repository: "openshift/origin-*"}, image: "openshift/origin-node:v3.6", ok: true},
+		{name: "official familiar", match: ImageMatchConfig{Repository: "busybox"}, image: "docker.io/library/busybox", ok: true},
+		{name: "official library", match: ImageMatchConfig{Repository: "library/busybox"}, image: "busybox", ok: true},
+		{name: "default registry", match: ImageMatchConfig{Registry: "docker.io"}, image: "openshift/origin", ok: true},
+		{name: "legacy registry", match: ImageMatchConfig{Registry: "index.docker.io"}, image: "openshift/origin", ok: true},
+		{name: "registry with port", match: ImageMatchConfig{Registry: "registry.local:5000", Repository: "origin"}, image: "registry.local:5000/origin:v3.6", ok: true},
+		{name: "other registry", match: ImageMatchConfig{Registry: "docker.io"}, image: "registry.local:5000/origin", ok: false},
+		{name: "tag pattern", match: ImageMatchConfig{Tag: "v3.*"}, image: "openshift/origin:v3.6", ok: true},
+		{name: "default tag", match: ImageMatchConfig{Tag: "latest"}, image: "openshift/origin", ok: true},
+		{name: "other tag", match: ImageMatchConfig{Tag: "v3.*"}, image: "openshift/origin:v1.5", ok: false},
+		{name: "digest", match: ImageMatchConfig{Digest: testDigest}, image: "openshift/origin@" + testDigest, ok: true},
+		{name: "no digest", match: ImageMatchConfig{Digest: testDigest}, image: "openshift/origin", ok: false},
+		{name: "uppercase", match: ImageMatchConfig{Repository: "*"}, image: "OpenShift/origin", ok: false},
+		{name: "empty tag", match: ImageMatchConfig{Repository: "*"}, image: "openshift/origin:", ok: false},
+	}
+	for _, test := range tests {
+		ok, reason := matchImage(&test.match, test.image)
+		if ok != test.ok {
+			t.Errorf("%s: expected match %t for %q, got %t (%s)", test.name, test.ok, test.image, ok, reason)
+		}
+		if !ok && len(reason) == 0 {
+			t.Errorf("%s: no reason given for not matching %q", test.name, test.image)
+		}
+	}
+}
+
+func TestEscapeImageName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"busybox", "busybox"},
+		{"registry.local:5000/openshift/origin:v3.6", "registry.local:5000/openshift/origin:v3.6"},
+		{"openshift/origin@" + testDigest, "openshift/origin@" + testDigest},
+		{"foo?bar", "foo%3Fbar"},
+		{"foo#bar/baz%", "foo%23bar/baz%25"},
+		{"a b", "a%20b"},
+	}
+	for _, test := range tests {
+		if actual := escapeImageName(test.name); actual != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+}
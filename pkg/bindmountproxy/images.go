@@ -0,0 +1,133 @@
+package bindmountproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// imageInfo is the part of the Docker image inspect response used to match rules
+type imageInfo struct {
+	ID          string   `json:"Id"`
+	RepoDigests []string `json:"RepoDigests"`
+	Config      *struct {
+		Cmd        []string          `json:"Cmd"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Env        []string          `json:"Env"`
+		Labels     map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// imageInspector looks up images in the Docker daemon
+type imageInspector interface {
+	inspectImage(name string) (*imageInfo, error)
+}
+
+// daemonClient inspects images and containers in the Docker daemon
+type daemonClient struct {
+	client *http.Client
+}
+
+func newDaemonClient(backend *dockerproxy.Backend) *daemonClient {
+	return &daemonClient{client: backend.Client()}
+}
+
+// escapeImageName escapes an image name for the path of an API request. The
+// daemon routes image names with their slashes, so each segment is escaped
+// separately.
+func escapeImageName(name string) string {
+	segments := strings.Split(name, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func (c *daemonClient) inspectImage(name string) (*imageInfo, error) {
+	resp, err := c.client.Get("http://docker/images/" + escapeImageName(name) + "/json")
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect image %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot inspect image %s: daemon returned %s", name, resp.Status)
+	}
+	info := &imageInfo{}
+	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("cannot decode image %s: %v", name, err)
+	}
+	return info, nil
+}
+
+// containerInfo is the part of the Docker container inspect response used to
+// match rules against existing containers
+type containerInfo struct {
+	ID         string               `json:"Id"`
+	Name       string               `json:"Name"`
+	Config     *createContainerData `json:"Config"`
+	HostConfig *struct {
+		Binds []string          `json:"Binds"`
+		Tmpfs map[string]string `json:"Tmpfs"`
+	} `json:"HostConfig"`
+	Mounts []struct {
+		Destination string `json:"Destination"`
+	} `json:"Mounts"`
+}
+
+// containerInspector looks up containers in the Docker daemon
+type containerInspector interface {
+	inspectContainer(id string) (*containerInfo, error)
+}
+
+func (c *daemonClient) inspectContainer(id string) (*containerInfo, error) {
+	resp, err := c.client.Get("http://docker/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect container %s: %v", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot inspect container %s: daemon returned %s", id, resp.Status)
+	}
+	info := &containerInfo{}
+	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("cannot decode container %s: %v", id, err)
+	}
+	return info, nil
+}
+
+// createRequest returns the container as a create request, so that rules can
+// be matched against it
+func (c *containerInfo) createRequest(version dockerproxy.APIVersion, images imageInspector) *createRequest {
+	data := c.Config
+	if data == nil {
+		data = &createContainerData{}
+	}
+	return &createRequest{
+		data:       data,
+		name:       strings.TrimPrefix(c.Name, "/"),
+		apiVersion: version,
+		images:     images,
+	}
+}
+
+// destinations returns the container paths that something is mounted at
+func (c *containerInfo) destinations() map[string]bool {
+	destinations := map[string]bool{}
+	for _, m := range c.Mounts {
+		destinations[filepath.Clean(m.Destination)] = true
+	}
+	if c.HostConfig != nil {
+		for _, bind := range c.HostConfig.Binds {
+			destinations[bindTarget(bind)] = true
+		}
+		for target := range c.HostConfig.Tmpfs {
+			destinations[filepath.Clean(target)] = true
+		}
+	}
+	return destinations
+}
@@ -0,0 +1,290 @@
+package bindmountproxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// MatchConfig selects containers by properties other than their image name.
+// All selectors that are specified must match for a rule to apply.
+type MatchConfig struct {
+	// Labels maps label names to regular expressions that must match the
+	// whole label value. An empty expression only requires the label to be set.
+	Labels map[string]string `json:"labels,omitempty"`
+	// ContainerName is a regular expression matched against the name given
+	// to the container when it is created
+	ContainerName string `json:"containerName,omitempty"`
+	// Command is a regular expression matched against the entrypoint and
+	// command the container runs, joined by spaces
+	Command string `json:"command,omitempty"`
+	// Env maps environment variable names to regular expressions that must
+	// match the whole value. An empty expression only requires the variable
+	// to be set.
+	Env map[string]string `json:"env,omitempty"`
+	// ImageDigest is the digest (sha256:...) the image resolves to in the
+	// daemon, either its ID or one of its repository digests
+	ImageDigest string `json:"imageDigest,omitempty"`
+}
+
+// selector is a compiled MatchConfig
+type selector struct {
+	labels        map[string]*regexp.Regexp
+	containerName *regexp.Regexp
+	command       *regexp.Regexp
+	env           map[string]*regexp.Regexp
+	imageDigest   string
+}
+
+var digestPattern = regexp.MustCompile(`^[a-z0-9]+:[a-f0-9]{32,}$`)
+
+func compileSelector(match *MatchConfig, invalid func(field, format string, args ...interface{})) *selector {
+	s := &selector{imageDigest: match.ImageDigest}
+	compile := func(field, expr string) *regexp.Regexp {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			invalid(field, "invalid regular expression: %v", err)
+		}
+		return re
+	}
+	// wholeValue compiles an expression that must match an entire value
+	wholeValue := func(field, expr string) *regexp.Regexp {
+		if _, err := regexp.Compile(expr); err != nil {
+			invalid(field, "invalid regular expression: %v", err)
+			return nil
+		}
+		return regexp.MustCompile("^(?:" + expr + ")$")
+	}
+
+	if len(match.Labels) > 0 {
+		s.labels = map[string]*regexp.Regexp{}
+		for name, expr := range match.Labels {
+			if len(name) == 0 {
+				invalid("match.labels", "label names cannot be empty")
+				continue
+			}
+			if len(expr) > 0 {
+				s.labels[name] = wholeValue(fmt.Sprintf("match.labels[%s]", name), expr)
+			} else {
+				s.labels[name] = nil
+			}
+		}
+	}
+	if len(match.ContainerName) > 0 {
+		s.containerName = compile("match.containerName", match.ContainerName)
+	}
+	if len(match.Command) > 0 {
+		s.command = compile("match.command", match.Command)
+	}
+	if len(match.Env) > 0 {
+		s.env = map[string]*regexp.Regexp{}
+		for name, expr := range match.Env {
+			if msg := validateEnvName(name); len(msg) > 0 {
+				invalid("match.env", "%s", msg)
+				continue
+			}
+			if len(expr) > 0 {
+				s.env[name] = wholeValue(fmt.Sprintf("match.env[%s]", name), expr)
+			} else {
+				s.env[name] = nil
+			}
+		}
+	}
+	if len(match.ImageDigest) > 0 && !digestPattern.MatchString(match.ImageDigest) {
+		invalid("match.imageDigest", "%q is not a valid digest, expected algorithm:hex", match.ImageDigest)
+	}
+	return s
+}
+
+// createRequest is a container create request that rules are matched against
+type createRequest struct {
+	data *createContainerData
+	// name is the container name requested by the client, if any
+	name string
+	// apiVersion is the Docker API version of the request, if known
+	apiVersion dockerproxy.APIVersion
+
+	images    imageInspector
+	image     *imageInfo
+	imageErr  error
+	inspected bool
+}
+
+// imageInfo returns the inspected image of the request, looking it up in
+// the daemon the first time it is needed
+func (req *createRequest) imageInfo() (*imageInfo, error) {
+	if !req.inspected {
+		req.inspected = true
+		if req.images == nil {
+			req.imageErr = fmt.Errorf("images cannot be inspected")
+		} else {
+			req.image, req.imageErr = req.images.inspectImage(req.data.Image)
+		}
+		if req.imageErr != nil {
+			glog.V(2).Infof("Matching without image details: %v", req.imageErr)
+		}
+	}
+	return req.image, req.imageErr
+}
+
+// imageConfigured returns whether the image of the request could be inspected
+// and has a configuration
+func (req *createRequest) imageConfigured() bool {
+	image, err := req.imageInfo()
+	return err == nil && image.Config != nil
+}
+
+// labels returns the labels the container will have, including those
+// inherited from its image
+func (req *createRequest) labels() map[string]string {
+	labels := map[string]string{}
+	if req.imageConfigured() {
+		for k, v := range req.image.Config.Labels {
+			labels[k] = v
+		}
+	}
+	for k, v := range req.data.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// env returns the environment the container will have, including the
+// variables set by its image
+func (req *createRequest) env() map[string]string {
+	env := map[string]string{}
+	var vars []string
+	if req.imageConfigured() {
+		vars = append(vars, req.image.Config.Env...)
+	}
+	vars = append(vars, req.data.Env...)
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		} else {
+			env[parts[0]] = ""
+		}
+	}
+	return env
+}
+
+// command returns the entrypoint and command the container will run, taking
+// the defaults from its image the way the daemon does
+func (req *createRequest) command() string {
+	entrypoint, cmd := req.data.Entrypoint, req.data.Cmd
+	if entrypoint == nil && req.imageConfigured() {
+		entrypoint = req.image.Config.Entrypoint
+		if cmd == nil {
+			cmd = req.image.Config.Cmd
+		}
+	}
+	return strings.Join(append(append([]string{}, entrypoint...), cmd...), " ")
+}
+
+// matchAPIVersion returns whether an API version is within the bounds of the
+// rule. Requests whose version is not known only match rules without bounds.
+func (r *rule) matchAPIVersion(version dockerproxy.APIVersion) (bool, string) {
+	if r.minVersion.IsZero() && r.maxVersion.IsZero() {
+		return true, ""
+	}
+	switch {
+	case version.IsZero():
+		return false, "the API version of the request is not known"
+	case !r.minVersion.IsZero() && version.Compare(r.minVersion) < 0:
+		return false, fmt.Sprintf("API version %s is lower than minAPIVersion %s", version, r.minVersion)
+	case !r.maxVersion.IsZero() && version.Compare(r.maxVersion) > 0:
+		return false, fmt.Sprintf("API version %s is higher than maxAPIVersion %s", version, r.maxVersion)
+	}
+	return true, ""
+}
+
+// match returns whether the rule applies to the request and, if it does not,
+// the reason why
+func (r *rule) match(req *createRequest) (bool, string) {
+	if ok, reason := r.matchAPIVersion(req.apiVersion); !ok {
+		return false, reason
+	}
+	if r.imagePattern != nil && !r.imagePattern.MatchString(req.data.Image) {
+		return false, fmt.Sprintf("image %q does not match pattern %q", req.data.Image, r.ImagePattern)
+	}
+	if r.Image != nil {
+		if ok, reason := matchImage(r.Image, req.data.Image); !ok {
+			return false, reason
+		}
+	}
+	if r.selector == nil {
+		return true, ""
+	}
+	s := r.selector
+	if s.containerName != nil {
+		name := strings.TrimPrefix(req.name, "/")
+		if !s.containerName.MatchString(name) {
+			return false, fmt.Sprintf("container name %q does not match %q", name, r.Match.ContainerName)
+		}
+	}
+	if len(s.labels) > 0 {
+		if ok, reason := matchValues("label", s.labels, r.Match.Labels, req.labels()); !ok {
+			return false, reason
+		}
+	}
+	if len(s.env) > 0 {
+		if ok, reason := matchValues("environment variable", s.env, r.Match.Env, req.env()); !ok {
+			return false, reason
+		}
+	}
+	if s.command != nil {
+		command := req.command()
+		if !s.command.MatchString(command) {
+			return false, fmt.Sprintf("command %q does not match %q", command, r.Match.Command)
+		}
+	}
+	if len(s.imageDigest) > 0 {
+		image, err := req.imageInfo()
+		if err != nil {
+			return false, fmt.Sprintf("image digest is unknown: %v", err)
+		}
+		if !hasDigest(image, s.imageDigest) {
+			return false, fmt.Sprintf("image %q does not resolve to %s", req.data.Image, s.imageDigest)
+		}
+	}
+	return true, ""
+}
+
+// matchValues checks that every expected name is present in values, with a
+// value matching its expression if one is given. exprs holds the expressions
+// as configured, to report them.
+func matchValues(kind string, expected map[string]*regexp.Regexp, exprs, values map[string]string) (bool, string) {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := values[name]
+		if !ok {
+			return false, fmt.Sprintf("%s %s is not set", kind, name)
+		}
+		if re := expected[name]; re != nil && !re.MatchString(value) {
+			return false, fmt.Sprintf("%s %s=%q does not match %q", kind, name, value, exprs[name])
+		}
+	}
+	return true, ""
+}
+
+func hasDigest(image *imageInfo, digest string) bool {
+	if image.ID == digest {
+		return true
+	}
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return true
+		}
+	}
+	return false
+}
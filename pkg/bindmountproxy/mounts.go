@@ -0,0 +1,316 @@
+package bindmountproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount types
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// Mount styles determine how mounts are added to a container create request
+const (
+	// MountStyleBinds adds mounts to HostConfig.Binds (and HostConfig.Tmpfs),
+	// which is understood by every Docker API version
+	MountStyleBinds = "binds"
+	// MountStyleMounts adds mounts to HostConfig.Mounts, available since API 1.25
+	MountStyleMounts = "mounts"
+)
+
+// Conflict policies determine what happens when a destination is already mounted
+const (
+	ConflictReplace = "replace"
+	ConflictSkip    = "skip"
+	ConflictFail    = "fail"
+)
+
+// SELinux label modes
+const (
+	SELinuxLabelShared  = "z"
+	SELinuxLabelPrivate = "Z"
+	SELinuxLabelNone    = "none"
+)
+
+var propagationModes = map[string]bool{
+	"rprivate": true,
+	"private":  true,
+	"rshared":  true,
+	"shared":   true,
+	"rslave":   true,
+	"slave":    true,
+}
+
+// apiMount is an entry of HostConfig.Mounts
+type apiMount struct {
+	Type          string         `json:"Type,omitempty"`
+	Source        string         `json:"Source,omitempty"`
+	Target        string         `json:"Target,omitempty"`
+	ReadOnly      bool           `json:"ReadOnly,omitempty"`
+	Consistency   string         `json:"Consistency,omitempty"`
+	BindOptions   *bindOptions   `json:"BindOptions,omitempty"`
+	VolumeOptions *volumeOptions `json:"VolumeOptions,omitempty"`
+	TmpfsOptions  *tmpfsOptions  `json:"TmpfsOptions,omitempty"`
+}
+
+type bindOptions struct {
+	Propagation string `json:"Propagation,omitempty"`
+}
+
+type volumeOptions struct {
+	NoCopy       bool              `json:"NoCopy,omitempty"`
+	Labels       map[string]string `json:"Labels,omitempty"`
+	DriverConfig *volumeDriver     `json:"DriverConfig,omitempty"`
+}
+
+type volumeDriver struct {
+	Name    string            `json:"Name,omitempty"`
+	Options map[string]string `json:"Options,omitempty"`
+}
+
+type tmpfsOptions struct {
+	SizeBytes int64  `json:"SizeBytes,omitempty"`
+	Mode      uint32 `json:"Mode,omitempty"`
+}
+
+// addMount adds a configured mount to the create request in the given style
+func (d *createDocument) addMount(style string, mount BindMountConfig) error {
+	hc := d.ensureHostConfig()
+	d.changed = true
+	if style == MountStyleMounts {
+		var mounts []json.RawMessage
+		if _, err := hc.decode("Mounts", &mounts); err != nil {
+			return err
+		}
+		m, err := json.Marshal(structuredMount(mount))
+		if err != nil {
+			return err
+		}
+		return hc.set("Mounts", append(mounts, m))
+	}
+	if mountType(mount) == MountTypeTmpfs {
+		tmpfs := newJSONObject()
+		if _, err := hc.decode("Tmpfs", tmpfs); err != nil {
+			return err
+		}
+		if err := tmpfs.set(mount.Destination, tmpfsBindOptions(mount)); err != nil {
+			return err
+		}
+		return hc.set("Tmpfs", tmpfs)
+	}
+	var binds []string
+	if _, err := hc.decode("Binds", &binds); err != nil {
+		return err
+	}
+	return hc.set("Binds", append(binds, bindSpec(mount)))
+}
+
+// bindSpec returns the source:destination[:options] form of a mount used in
+// HostConfig.Binds
+func bindSpec(mount BindMountConfig) string {
+	var opts []string
+	if mount.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	label := mount.SELinuxLabel
+	if len(label) == 0 && mountType(mount) == MountTypeBind {
+		label = SELinuxLabelShared
+	}
+	if label != SELinuxLabelNone && len(label) > 0 {
+		opts = append(opts, label)
+	}
+	if len(mount.Propagation) > 0 {
+		opts = append(opts, mount.Propagation)
+	}
+	spec := fmt.Sprintf("%s:%s", mount.Source, mount.Destination)
+	if len(opts) > 0 {
+		spec += ":" + strings.Join(opts, ",")
+	}
+	return spec
+}
+
+func structuredMount(mount BindMountConfig) apiMount {
+	m := apiMount{
+		Type:     mountType(mount),
+		Source:   mount.Source,
+		Target:   mount.Destination,
+		ReadOnly: mount.ReadOnly,
+	}
+	switch m.Type {
+	case MountTypeBind:
+		if len(mount.Propagation) > 0 {
+			m.BindOptions = &bindOptions{Propagation: mount.Propagation}
+		}
+	case MountTypeTmpfs:
+		m.Source = ""
+		if mount.TmpfsSize > 0 {
+			m.TmpfsOptions = &tmpfsOptions{SizeBytes: mount.TmpfsSize}
+		}
+	}
+	return m
+}
+
+// tmpfsBindOptions returns the options of a tmpfs mount in the format used by
+// HostConfig.Tmpfs
+func tmpfsBindOptions(mount BindMountConfig) string {
+	var opts []string
+	if mount.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	if mount.TmpfsSize > 0 {
+		opts = append(opts, "size="+strconv.FormatInt(mount.TmpfsSize, 10))
+	}
+	return strings.Join(opts, ",")
+}
+
+// isMounted returns whether the create request already mounts something at
+// the given destination, either as a bind, a structured mount, a tmpfs or a
+// volume
+func (d *createDocument) isMounted(destination string) (bool, error) {
+	destination = filepath.Clean(destination)
+	volumes := newJSONObject()
+	if _, err := d.root.decode("Volumes", volumes); err != nil {
+		return false, err
+	}
+	for _, target := range volumes.keys {
+		if filepath.Clean(target) == destination {
+			return true, nil
+		}
+	}
+	hc := d.hostConfig
+	if hc == nil {
+		return false, nil
+	}
+	var binds []string
+	if _, err := hc.decode("Binds", &binds); err != nil {
+		return false, err
+	}
+	for _, bind := range binds {
+		if bindTarget(bind) == destination {
+			return true, nil
+		}
+	}
+	var mounts []json.RawMessage
+	if _, err := hc.decode("Mounts", &mounts); err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		target, err := mountTarget(m)
+		if err != nil {
+			return false, err
+		}
+		if target == destination {
+			return true, nil
+		}
+	}
+	tmpfs := newJSONObject()
+	if _, err := hc.decode("Tmpfs", tmpfs); err != nil {
+		return false, err
+	}
+	for _, target := range tmpfs.keys {
+		if filepath.Clean(target) == destination {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unmount removes everything mounted at the given destination from the
+// create request
+func (d *createDocument) unmount(destination string) error {
+	destination = filepath.Clean(destination)
+	d.changed = true
+	if err := removeTargets(d.root, "Volumes", destination); err != nil {
+		return err
+	}
+	hc := d.hostConfig
+	if hc == nil {
+		return nil
+	}
+	var binds []string
+	ok, err := hc.decode("Binds", &binds)
+	if err != nil {
+		return err
+	}
+	if ok {
+		kept := []string{}
+		for _, bind := range binds {
+			if bindTarget(bind) != destination {
+				kept = append(kept, bind)
+			}
+		}
+		if err = hc.set("Binds", kept); err != nil {
+			return err
+		}
+	}
+	var mounts []json.RawMessage
+	if ok, err = hc.decode("Mounts", &mounts); err != nil {
+		return err
+	}
+	if ok {
+		kept := []json.RawMessage{}
+		for _, m := range mounts {
+			target, err := mountTarget(m)
+			if err != nil {
+				return err
+			}
+			if target != destination {
+				kept = append(kept, m)
+			}
+		}
+		if err = hc.set("Mounts", kept); err != nil {
+			return err
+		}
+	}
+	return removeTargets(hc, "Tmpfs", destination)
+}
+
+// removeTargets removes the keys that are the given container path from the
+// object in a field, such as Volumes or HostConfig.Tmpfs
+func removeTargets(object *jsonObject, field, destination string) error {
+	targets := newJSONObject()
+	ok, err := object.decode(field, targets)
+	if !ok || err != nil {
+		return err
+	}
+	for _, target := range append([]string(nil), targets.keys...) {
+		if filepath.Clean(target) == destination {
+			targets.remove(target)
+		}
+	}
+	return object.set(field, targets)
+}
+
+// mountTarget returns the container path of an entry of HostConfig.Mounts
+func mountTarget(m json.RawMessage) (string, error) {
+	mount := struct {
+		Target string
+	}{}
+	if err := json.Unmarshal(m, &mount); err != nil {
+		return "", fmt.Errorf("invalid HostConfig.Mounts: %v", err)
+	}
+	return filepath.Clean(mount.Target), nil
+}
+
+// bindTarget returns the container path of a source:destination[:options]
+// bind, or of a bare container path
+func bindTarget(bind string) string {
+	parts := strings.Split(bind, ":")
+	if len(parts) == 1 {
+		return filepath.Clean(parts[0])
+	}
+	return filepath.Clean(parts[1])
+}
+
+func mountType(mount BindMountConfig) string {
+	if len(mount.Type) == 0 {
+		return MountTypeBind
+	}
+	return mount.Type
+}
@@ -0,0 +1,208 @@
+package bindmountproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// ImageInterceptor is the name of the interceptor that applies image
+// replacements to image pulls
+const ImageInterceptor = "image-rules"
+
+// registryAuthHeader holds the registry credentials of an image pull
+const registryAuthHeader = "X-Registry-Auth"
+
+// What happens when the replacement of an image does not exist locally
+const (
+	ReplaceMissingFail = "fail"
+	ReplaceMissingKeep = "keep"
+)
+
+// ReplaceImageConfig makes matching containers run a different image than the
+// one they were created with
+type ReplaceImageConfig struct {
+	// Image is the image the container runs instead. $1 or ${name} are
+	// replaced by the groups of imagePattern matched in the requested image.
+	Image string `json:"image"`
+	// Pulls also replaces the image of matching image pulls. A replacement
+	// that exists locally is not pulled at all.
+	Pulls bool `json:"pulls,omitempty"`
+	// IfMissing determines what happens when the replacement does not exist
+	// locally: fail the create request (the default), or keep the requested
+	// image
+	IfMissing string `json:"ifMissing,omitempty"`
+}
+
+func validateReplaceImage(replace *ReplaceImageConfig, imagePattern string, invalid func(field, format string, args ...interface{})) {
+	switch {
+	case len(replace.Image) == 0:
+		invalid("replaceImage.image", "an image is required")
+	case strings.Contains(replace.Image, "$"):
+		if len(imagePattern) == 0 {
+			invalid("replaceImage.image", "groups can only be substituted from an imagePattern")
+		}
+	default:
+		if _, err := parseImageReference(replace.Image); err != nil {
+			invalid("replaceImage.image", "%v", err)
+		}
+	}
+	switch replace.IfMissing {
+	case "", ReplaceMissingFail, ReplaceMissingKeep:
+	default:
+		invalid("replaceImage.ifMissing", "unknown policy %q, expected %s or %s", replace.IfMissing, ReplaceMissingFail, ReplaceMissingKeep)
+	}
+}
+
+// replacementImage returns the image a rule replaces the given image with
+func (r *rule) replacementImage(image string) string {
+	if r.imagePattern == nil {
+		return r.ReplaceImage.Image
+	}
+	groups := r.imagePattern.FindStringSubmatchIndex(image)
+	if groups == nil {
+		return r.ReplaceImage.Image
+	}
+	return string(r.imagePattern.ExpandString(nil, r.ReplaceImage.Image, image, groups))
+}
+
+// replaceImage replaces the image of a container create request with the
+// replacement of the first matching rule that has one
+func replaceImage(matched []*rule, req *createRequest, doc *createDocument, rewrite *createRewrite) error {
+	var r *rule
+	for _, candidate := range matched {
+		if candidate.ReplaceImage != nil {
+			r = candidate
+			break
+		}
+	}
+	if r == nil {
+		return nil
+	}
+	image := r.replacementImage(req.data.Image)
+	if image == req.data.Image {
+		return nil
+	}
+	// Without a daemon, as when explaining a request, the replacement is
+	// assumed to exist
+	if req.images != nil {
+		if _, err := req.images.inspectImage(image); err != nil {
+			if r.ReplaceImage.IfMissing == ReplaceMissingKeep {
+				glog.Warningf("Not replacing image %s with %s: %v", req.data.Image, image, err)
+				return nil
+			}
+			return dockerproxy.NotFound("image %s, which rule %s replaces %s with, does not exist locally: %v", image, r.label(), req.data.Image, err)
+		}
+	}
+	glog.V(2).Infof("Replacing image %s with %s", req.data.Image, image)
+	if err := doc.setImage(image); err != nil {
+		return err
+	}
+	rewrite.replacedImage = image
+	return nil
+}
+
+// imagePullModifier replaces the images of pulls with the replacements of the
+// rules that apply to pulls. Rules are matched against the pulled image the
+// way they are matched against the image of a create request.
+func imagePullModifier(rules func() *RuleSet, images imageInspector) dockerproxy.BeforeFunc {
+	return func(req *http.Request) (*http.Request, *http.Response, error) {
+		route := dockerproxy.RouteOf(req)
+		query := req.URL.Query()
+		// Imports (fromSrc) do not pull an image
+		if route.Route != dockerproxy.RouteImagePull || len(query.Get("fromImage")) == 0 {
+			return req, nil, nil
+		}
+		image := joinImageReference(query.Get("fromImage"), query.Get("tag"))
+		matchReq := &createRequest{
+			data:       &createContainerData{Image: image},
+			apiVersion: route.Version,
+		}
+		var r *rule
+		for _, candidate := range rules().rules {
+			if candidate.ReplaceImage == nil || !candidate.ReplaceImage.Pulls {
+				continue
+			}
+			ok, reason := candidate.match(matchReq)
+			if ok {
+				r = candidate
+				break
+			}
+			glog.V(4).Infof("Rule %d does not apply to pull of %s: %s", candidate.index, image, reason)
+		}
+		if r == nil {
+			return req, nil, nil
+		}
+		replacement := r.replacementImage(image)
+		if replacement == image {
+			return req, nil, nil
+		}
+		if _, err := images.inspectImage(replacement); err == nil {
+			glog.V(2).Infof("Not pulling %s, its replacement %s exists locally", image, replacement)
+			return req, pullUpToDate(req, replacement), nil
+		}
+		glog.V(2).Infof("Pulling %s instead of %s", replacement, image)
+		name, tag := splitImageReference(replacement)
+		query.Set("fromImage", name)
+		query.Set("tag", tag)
+		newReq := req.WithContext(req.Context())
+		u := *req.URL
+		u.RawQuery = query.Encode()
+		newReq.URL = &u
+		// The credentials of the client are for the registry of the image it
+		// asked for, and are not sent to another registry
+		if len(req.Header.Get(registryAuthHeader)) > 0 && !sameRegistry(image, replacement) {
+			glog.V(2).Infof("Pulling %s without the credentials given for %s", replacement, image)
+			newReq.Header = http.Header{}
+			for key, values := range req.Header {
+				if key != registryAuthHeader {
+					newReq.Header[key] = append([]string(nil), values...)
+				}
+			}
+		}
+		return newReq, nil, nil
+	}
+}
+
+// sameRegistry returns whether two image references are pulled from the same
+// registry
+func sameRegistry(image, other string) bool {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return false
+	}
+	otherRef, err := parseImageReference(other)
+	if err != nil {
+		return false
+	}
+	return ref.registry == otherRef.registry
+}
+
+// pullUpToDate returns the progress stream of a pull that found the image up
+// to date, which is what the daemon returns for an image it already has
+func pullUpToDate(req *http.Request, image string) *http.Response {
+	body := &bytes.Buffer{}
+	for _, status := range []string{
+		fmt.Sprintf("Pulling from %s", image),
+		fmt.Sprintf("Status: Image is up to date for %s", image),
+	} {
+		// Encoding a struct with a string field cannot fail
+		json.NewEncoder(body).Encode(struct {
+			Status string `json:"status"`
+		}{status})
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(body),
+		ContentLength: int64(body.Len()),
+		Request:       req,
+	}
+}
@@ -0,0 +1,296 @@
+package bindmountproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/csrwng/bindmountproxy/pkg/dockerproxy"
+)
+
+// volumeNamePattern matches the names Docker accepts for named volumes
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// RuleSet is a validated proxy configuration with its image patterns compiled,
+// ready to be applied to container create requests. A RuleSet is immutable.
+type RuleSet struct {
+	config  *BindMountProxyConfig
+	rules   []*rule
+	created time.Time
+}
+
+type rule struct {
+	ImageBindMountConfig
+	index        int
+	imagePattern *regexp.Regexp
+	selector     *selector
+	minVersion   dockerproxy.APIVersion
+	maxVersion   dockerproxy.APIVersion
+}
+
+// RuleError describes a problem with one of the rules in a configuration
+type RuleError struct {
+	// Index is the position of the rule in the configuration's bindMounts
+	Index int
+	// Name is the name of the rule, if it has one
+	Name string
+	// Source is the file the rule was loaded from, if known
+	Source string
+	// Field is the path of the offending field within the rule
+	Field   string
+	Message string
+}
+
+func (e RuleError) Error() string {
+	rule := fmt.Sprintf("bindMounts[%d]", e.Index)
+	if len(e.Name) > 0 {
+		rule += fmt.Sprintf(" (%s)", e.Name)
+	}
+	if len(e.Source) > 0 {
+		rule = e.Source + ": " + rule
+	}
+	if len(e.Field) == 0 {
+		return fmt.Sprintf("%s: %s", rule, e.Message)
+	}
+	return fmt.Sprintf("%s.%s: %s", rule, e.Field, e.Message)
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []RuleError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ruleErr := range e {
+		msgs = append(msgs, ruleErr.Error())
+	}
+	return fmt.Sprintf("%d invalid rule setting(s):\n  %s", len(e), strings.Join(msgs, "\n  "))
+}
+
+// NewRuleSet validates the given configuration and compiles it into a RuleSet.
+// If the configuration has problems, a ValidationError listing all of them is
+// returned. A nil configuration is an empty one, without rules.
+func NewRuleSet(config *BindMountProxyConfig) (*RuleSet, error) {
+	if config == nil {
+		config = &BindMountProxyConfig{}
+	}
+	ruleSet := &RuleSet{config: config, created: time.Now()}
+	var errs ValidationError
+	names := map[string]int{}
+	for i, imageConfig := range config.BindMounts {
+		if len(imageConfig.Name) > 0 {
+			if first, exists := names[imageConfig.Name]; exists {
+				errs = append(errs, RuleError{
+					Index:   i,
+					Name:    imageConfig.Name,
+					Source:  imageConfig.source,
+					Message: fmt.Sprintf("duplicate rule name, already used by bindMounts[%d]", first),
+				})
+			}
+			names[imageConfig.Name] = i
+		}
+		// Disabled rules are not validated, so that a rule can be disabled
+		// without being complete
+		if imageConfig.Disabled {
+			continue
+		}
+		r, ruleErrs := compileRule(i, imageConfig)
+		errs = append(errs, ruleErrs...)
+		ruleSet.rules = append(ruleSet.rules, r)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return ruleSet, nil
+}
+
+// Config returns the configuration the rule set was built from
+func (r *RuleSet) Config() *BindMountProxyConfig {
+	return r.config
+}
+
+// Len returns the number of rules that are applied, which excludes disabled
+// rules
+func (r *RuleSet) Len() int {
+	return len(r.rules)
+}
+
+// Created returns when the rule set was built, which is when its
+// configuration was loaded
+func (r *RuleSet) Created() time.Time {
+	return r.created
+}
+
+func compileRule(index int, imageConfig ImageBindMountConfig) (*rule, []RuleError) {
+	var errs []RuleError
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, RuleError{
+			Index:   index,
+			Name:    imageConfig.Name,
+			Source:  imageConfig.source,
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	r := &rule{ImageBindMountConfig: imageConfig, index: index}
+	if len(imageConfig.ImagePattern) == 0 && imageConfig.Image == nil && imageConfig.Match == nil {
+		invalid("imagePattern", "an image pattern, image matcher or match selectors are required")
+	} else if len(imageConfig.ImagePattern) > 0 {
+		if re, err := regexp.Compile(imageConfig.ImagePattern); err != nil {
+			invalid("imagePattern", "invalid regular expression: %v", err)
+		} else {
+			r.imagePattern = re
+		}
+	}
+	if imageConfig.Image != nil {
+		validateImageMatch(imageConfig.Image, invalid)
+	}
+	if imageConfig.Match != nil {
+		r.selector = compileSelector(imageConfig.Match, invalid)
+	}
+
+	r.minVersion = parseRuleAPIVersion("minAPIVersion", imageConfig.MinAPIVersion, invalid)
+	r.maxVersion = parseRuleAPIVersion("maxAPIVersion", imageConfig.MaxAPIVersion, invalid)
+	if !r.minVersion.IsZero() && !r.maxVersion.IsZero() && r.minVersion.Compare(r.maxVersion) > 0 {
+		invalid("maxAPIVersion", "%s is lower than minAPIVersion %s", r.maxVersion, r.minVersion)
+	}
+
+	switch imageConfig.MountStyle {
+	case "", MountStyleBinds, MountStyleMounts:
+	default:
+		invalid("mountStyle", "unknown mount style %q, expected %s or %s", imageConfig.MountStyle, MountStyleBinds, MountStyleMounts)
+	}
+
+	switch imageConfig.OnConflict {
+	case "", ConflictReplace, ConflictSkip, ConflictFail:
+	default:
+		invalid("onConflict", "unknown conflict policy %q, expected %s, %s or %s", imageConfig.OnConflict, ConflictReplace, ConflictSkip, ConflictFail)
+	}
+
+	for i, mount := range imageConfig.Mounts {
+		validateMount(fmt.Sprintf("mounts[%d]", i), imageConfig.MountStyle, mount, invalid)
+	}
+
+	for i, env := range imageConfig.Env {
+		if msg := validateEnvName(env.Name); len(msg) > 0 {
+			invalid(fmt.Sprintf("env[%d].name", i), "%s", msg)
+		}
+	}
+
+	if imageConfig.Exec != nil {
+		for i, env := range imageConfig.Exec.Env {
+			if msg := validateEnvName(env.Name); len(msg) > 0 {
+				invalid(fmt.Sprintf("exec.env[%d].name", i), "%s", msg)
+			}
+		}
+	}
+	if imageConfig.Update != nil {
+		for field := range imageConfig.Update.Set {
+			if len(field) == 0 {
+				invalid("update.set", "field names must not be empty")
+			}
+		}
+	}
+	if imageConfig.Build != nil {
+		validateBuild(imageConfig.Build, invalid)
+	}
+	if imageConfig.ReplaceImage != nil {
+		validateReplaceImage(imageConfig.ReplaceImage, imageConfig.ImagePattern, invalid)
+	}
+	switch imageConfig.VerifyOnStart {
+	case "":
+	case VerifyWarn, VerifyFail:
+		if len(imageConfig.Mounts) == 0 {
+			invalid("verifyOnStart", "the rule has no mounts to verify")
+		}
+	default:
+		invalid("verifyOnStart", "unknown verification %q, expected %s or %s", imageConfig.VerifyOnStart, VerifyWarn, VerifyFail)
+	}
+	return r, errs
+}
+
+// parseRuleAPIVersion parses an optional API version bound of a rule
+func parseRuleAPIVersion(field, value string, invalid func(field, format string, args ...interface{})) dockerproxy.APIVersion {
+	if len(value) == 0 {
+		return dockerproxy.APIVersion{}
+	}
+	version, err := dockerproxy.ParseAPIVersion(value)
+	if err != nil {
+		invalid(field, "%v", err)
+	}
+	return version
+}
+
+func validateMount(field, style string, mount BindMountConfig, invalid func(field, format string, args ...interface{})) {
+	field += "."
+	switch mountType(mount) {
+	case MountTypeBind:
+		switch {
+		case len(mount.Source) == 0:
+			invalid(field+"source", "a source path is required")
+		case !filepath.IsAbs(mount.Source):
+			invalid(field+"source", "%q is not an absolute path", mount.Source)
+		default:
+			if _, err := os.Stat(mount.Source); err != nil {
+				invalid(field+"source", "%v", err)
+			}
+		}
+	case MountTypeVolume:
+		if !volumeNamePattern.MatchString(mount.Source) {
+			invalid(field+"source", "%q is not a valid volume name", mount.Source)
+		}
+	case MountTypeTmpfs:
+		if len(mount.Source) > 0 {
+			invalid(field+"source", "tmpfs mounts do not have a source")
+		}
+	default:
+		invalid(field+"type", "unknown mount type %q, expected %s, %s or %s", mount.Type, MountTypeBind, MountTypeVolume, MountTypeTmpfs)
+	}
+	switch {
+	case len(mount.Destination) == 0:
+		invalid(field+"destination", "a destination path is required")
+	case !filepath.IsAbs(mount.Destination):
+		invalid(field+"destination", "%q is not an absolute path", mount.Destination)
+	}
+
+	if mount.TmpfsSize != 0 && mountType(mount) != MountTypeTmpfs {
+		invalid(field+"tmpfsSize", "only tmpfs mounts have a size")
+	}
+	if mount.TmpfsSize < 0 {
+		invalid(field+"tmpfsSize", "size cannot be negative")
+	}
+
+	switch mount.SELinuxLabel {
+	case "", SELinuxLabelNone:
+	case SELinuxLabelShared, SELinuxLabelPrivate:
+		switch {
+		case mountType(mount) == MountTypeTmpfs:
+			invalid(field+"selinuxLabel", "tmpfs mounts cannot be relabeled")
+		case style == MountStyleMounts:
+			invalid(field+"selinuxLabel", "relabeling is not supported with the %s mount style", MountStyleMounts)
+		}
+	default:
+		invalid(field+"selinuxLabel", "unknown label mode %q, expected %s, %s or %s", mount.SELinuxLabel, SELinuxLabelShared, SELinuxLabelPrivate, SELinuxLabelNone)
+	}
+
+	if len(mount.Propagation) > 0 {
+		if !propagationModes[mount.Propagation] {
+			invalid(field+"propagation", "unknown propagation mode %q", mount.Propagation)
+		} else if mountType(mount) != MountTypeBind {
+			invalid(field+"propagation", "propagation can only be set on bind mounts")
+		}
+	}
+}
+
+func validateEnvName(name string) string {
+	switch {
+	case len(name) == 0:
+		return "a variable name is required"
+	case strings.ContainsAny(name, "= \t\n\x00"):
+		return fmt.Sprintf("%q is not a valid variable name", name)
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package dockerproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/tlsconfig"
+)
+
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// BackendConfig specifies how to reach the Docker daemon that requests are
+// proxied to.
+type BackendConfig struct {
+	// Host is the daemon endpoint, either a unix socket (unix:///path/to/docker.sock
+	// or a plain absolute path) or a tcp://host:port address.
+	Host string
+
+	// TLS client settings, only used for tcp endpoints
+	TLSVerify bool
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+}
+
+// versionTimeout bounds how long the daemon may take to report its version
+const versionTimeout = 10 * time.Second
+
+// Backend dials connections to a Docker daemon
+type Backend struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	// transport is shared by the clients of the backend, so that their idle
+	// connections are reused
+	transport *http.Transport
+	client    *http.Client
+}
+
+// NewBackend parses the given backend configuration and returns a Backend
+// that can be used with New. An empty host defaults to DefaultDockerHost.
+func NewBackend(cfg BackendConfig) (*Backend, error) {
+	host := cfg.Host
+	if len(host) == 0 {
+		host = DefaultDockerHost
+	}
+	b := &Backend{}
+	switch {
+	case strings.HasPrefix(host, "/"):
+		b.network, b.address = "unix", host
+	case strings.Contains(host, "://"):
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid docker host %q: %v", host, err)
+		}
+		switch u.Scheme {
+		case "unix":
+			if len(u.Path) == 0 {
+				return nil, fmt.Errorf("invalid docker host %q: missing socket path", host)
+			}
+			b.network, b.address = "unix", u.Path
+		case "tcp", "https":
+			if len(u.Host) == 0 {
+				return nil, fmt.Errorf("invalid docker host %q: missing address", host)
+			}
+			b.network, b.address = "tcp", u.Host
+		default:
+			return nil, fmt.Errorf("invalid docker host %q: unsupported scheme %q", host, u.Scheme)
+		}
+	default:
+		return nil, fmt.Errorf("invalid docker host %q: expected unix:///path or tcp://host:port", host)
+	}
+
+	useTLS := cfg.TLSVerify || len(cfg.TLSCACert) > 0 || len(cfg.TLSCert) > 0 || len(cfg.TLSKey) > 0
+	if useTLS {
+		if b.network != "tcp" {
+			return nil, fmt.Errorf("TLS settings are only supported for tcp docker hosts, got %q", host)
+		}
+		if (len(cfg.TLSCert) > 0) != (len(cfg.TLSKey) > 0) {
+			return nil, fmt.Errorf("both a TLS client certificate and key must be specified")
+		}
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             cfg.TLSCACert,
+			CertFile:           cfg.TLSCert,
+			KeyFile:            cfg.TLSKey,
+			InsecureSkipVerify: !cfg.TLSVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		hostname, _, err := net.SplitHostPort(b.address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid docker host %q: %v", host, err)
+		}
+		tlsConfig.ServerName = hostname
+		b.tlsConfig = tlsConfig
+	}
+	b.transport = &http.Transport{
+		Dial: func(string, string) (net.Conn, error) {
+			return b.Dial()
+		},
+	}
+	b.client = &http.Client{Transport: b.transport}
+	return b, nil
+}
+
+// Dial opens a new connection to the Docker daemon
+func (b *Backend) Dial() (net.Conn, error) {
+	if b.tlsConfig != nil {
+		return tls.Dial(b.network, b.address, b.tlsConfig)
+	}
+	return net.Dial(b.network, b.address)
+}
+
+// Transport returns the HTTP transport whose connections go to the Docker
+// daemon. It is shared by every user of the backend.
+func (b *Backend) Transport() *http.Transport {
+	return b.transport
+}
+
+// Client returns an HTTP client that sends requests to the Docker daemon
+// regardless of the host in the request URL, for example http://docker/info.
+// It is shared by every user of the backend.
+func (b *Backend) Client() *http.Client {
+	return b.client
+}
+
+// APIVersion returns the API version the daemon uses for requests that do not
+// specify one, which is the latest version it supports
+func (b *Backend) APIVersion() (APIVersion, error) {
+	client := &http.Client{Transport: b.transport, Timeout: versionTimeout}
+	resp, err := client.Get("http://docker/version")
+	if err != nil {
+		return APIVersion{}, fmt.Errorf("cannot get the daemon version: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return APIVersion{}, fmt.Errorf("cannot get the daemon version: daemon returned %s", resp.Status)
+	}
+	version := struct {
+		APIVersion string `json:"ApiVersion"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return APIVersion{}, fmt.Errorf("cannot decode the daemon version: %v", err)
+	}
+	return ParseAPIVersion(version.APIVersion)
+}
+
+func (b *Backend) String() string {
+	scheme := b.network
+	if b.tlsConfig != nil {
+		scheme = "tcp+tls"
+	}
+	return fmt.Sprintf("%s://%s", scheme, b.address)
+}
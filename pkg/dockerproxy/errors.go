@@ -0,0 +1,55 @@
+package dockerproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// RequestError is an error that should be reported to the client with a
+// specific HTTP status code. Errors of any other type returned by a
+// RequestModifierFunc are reported as internal server errors.
+type RequestError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+// BadRequest returns an error that is reported to the client with a 400 status
+func BadRequest(format string, args ...interface{}) error {
+	return &RequestError{StatusCode: http.StatusBadRequest, Err: fmt.Errorf(format, args...)}
+}
+
+// NotFound returns an error that is reported to the client with a 404 status
+func NotFound(format string, args ...interface{}) error {
+	return &RequestError{StatusCode: http.StatusNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// errorResponse is the body the Docker daemon returns with failed requests
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// WriteError reports the error to the client the same way the Docker daemon
+// does, so that clients can display its message. The status code of a
+// RequestError is used; other errors are reported with defaultStatus.
+func WriteError(w http.ResponseWriter, err error, defaultStatus int) {
+	msg := "internal error"
+	if err != nil {
+		msg = err.Error()
+	}
+	status := defaultStatus
+	if reqErr, ok := err.(*RequestError); ok {
+		status = reqErr.StatusCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&errorResponse{Message: msg}); err != nil {
+		glog.Errorf("Error writing error response: %v", err)
+	}
+}
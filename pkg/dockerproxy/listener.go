@@ -0,0 +1,176 @@
+package dockerproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/tlsconfig"
+)
+
+// ListenConfig specifies how the proxy is exposed to Docker clients
+type ListenConfig struct {
+	// Spec is the address to listen on. It may be a port (:2375), an IP and
+	// port (127.0.0.1:2375), a tcp://host:port address or a unix:///path/to/proxy.sock
+	// socket path.
+	Spec string
+
+	// SocketMode and SocketOwner set the permissions and ownership (user[:group])
+	// of a unix socket. They are ignored for tcp listeners.
+	SocketMode  os.FileMode
+	SocketOwner string
+
+	// TLSCert and TLSKey enable TLS on the listener. If TLSCACert is also
+	// specified, clients must present a certificate signed by that CA.
+	TLSCert   string
+	TLSKey    string
+	TLSCACert string
+
+	// RequireClientCert refuses to listen on a tcp address unless clients
+	// have to present a certificate signed by TLSCACert. Unix sockets are
+	// protected by their permissions instead.
+	RequireClientCert bool
+}
+
+// Listen creates a listener for the given configuration
+func Listen(cfg ListenConfig) (net.Listener, error) {
+	network, address, err := parseListenSpec(cfg.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" && cfg.RequireClientCert && len(cfg.TLSCACert) == 0 {
+		return nil, fmt.Errorf("a TLS certificate, key and client CA certificate are required to listen on a tcp address")
+	}
+
+	var tlsConfig *tls.Config
+	if len(cfg.TLSCert) > 0 || len(cfg.TLSKey) > 0 || len(cfg.TLSCACert) > 0 {
+		if len(cfg.TLSCert) == 0 || len(cfg.TLSKey) == 0 {
+			return nil, fmt.Errorf("both a TLS certificate and key are required to listen with TLS")
+		}
+		opts := tlsconfig.Options{
+			CertFile: cfg.TLSCert,
+			KeyFile:  cfg.TLSKey,
+		}
+		if len(cfg.TLSCACert) > 0 {
+			opts.CAFile = cfg.TLSCACert
+			opts.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		if tlsConfig, err = tlsconfig.Server(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var l net.Listener
+	switch network {
+	case "unix":
+		l, err = listenUnix(address, cfg.SocketMode, cfg.SocketOwner)
+	default:
+		l, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+func parseListenSpec(spec string) (string, string, error) {
+	if len(spec) == 0 {
+		return "", "", fmt.Errorf("a listen address is required")
+	}
+	if !strings.Contains(spec, "://") {
+		return "tcp", spec, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %v", spec, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if len(u.Host) == 0 {
+			return "", "", fmt.Errorf("invalid listen address %q: missing address", spec)
+		}
+		return "tcp", u.Host, nil
+	case "unix":
+		if len(u.Path) == 0 {
+			return "", "", fmt.Errorf("invalid listen address %q: missing socket path", spec)
+		}
+		return "unix", u.Path, nil
+	}
+	return "", "", fmt.Errorf("invalid listen address %q: unsupported scheme %q", spec, u.Scheme)
+}
+
+func listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	// Remove a socket left behind by a previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("cannot remove stale socket %s: %v", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("cannot set mode of %s: %v", path, err)
+		}
+	}
+	if len(owner) > 0 {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err = os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("cannot set owner of %s: %v", path, err)
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner resolves a user[:group] specification, where user and group can
+// be either names or numeric ids. A missing group leaves the group unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	if len(userName) > 0 {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("cannot find socket owner %q: %v", userName, err)
+			}
+			if id, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("unexpected uid %q for user %q", u.Uid, userName)
+			}
+		}
+		uid = id
+	}
+	if len(groupName) > 0 {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("cannot find socket group %q: %v", groupName, err)
+			}
+			if id, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("unexpected gid %q for group %q", g.Gid, groupName)
+			}
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
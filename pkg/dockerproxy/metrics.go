@@ -0,0 +1,143 @@
+package dockerproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the requests handled by a proxy. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	modifierErrors  *prometheus.CounterVec
+	hijacked        prometheus.Gauge
+	hijackedBytes   *prometheus.CounterVec
+}
+
+// NewMetrics registers the proxy metrics, with names starting with namespace_
+func NewMetrics(registry prometheus.Registerer, namespace string) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests proxied to the Docker daemon, by method, API endpoint and status code.",
+		}, []string{"method", "endpoint", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to proxy requests that are not hijacked, by method and API endpoint.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "endpoint"}),
+		modifierErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "request_modification_failures_total",
+			Help:      "Requests that failed because they could not be modified, by API endpoint.",
+		}, []string{"endpoint"}),
+		// A gauge without labels is exported from the start, at zero
+		hijacked: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hijacked_connections",
+			Help:      "Hijacked connections, such as attach and exec sessions, that are currently open.",
+		}),
+		hijackedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hijacked_bytes_total",
+			Help:      "Bytes copied over hijacked connections, by direction (client_to_daemon or daemon_to_client).",
+		}, []string{"direction"}),
+	}
+	registry.MustRegister(m.requests, m.requestDuration, m.modifierErrors, m.hijacked, m.hijackedBytes)
+	return m
+}
+
+func (m *Metrics) observeRequest(req *http.Request, code string, start time.Time, hijacked bool) {
+	if m == nil {
+		return
+	}
+	endpoint := RouteOf(req).Endpoint
+	m.requests.WithLabelValues(req.Method, endpoint, code).Inc()
+	if !hijacked {
+		m.requestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) modifierFailed(req *http.Request) {
+	if m == nil {
+		return
+	}
+	m.modifierErrors.WithLabelValues(RouteOf(req).Endpoint).Inc()
+}
+
+func (m *Metrics) hijackStarted() {
+	if m != nil {
+		m.hijacked.Inc()
+	}
+}
+
+func (m *Metrics) hijackEnded() {
+	if m != nil {
+		m.hijacked.Dec()
+	}
+}
+
+func (m *Metrics) copied(direction string, n int64) {
+	if m != nil {
+		m.hijackedBytes.WithLabelValues(direction).Add(float64(n))
+	}
+}
+
+// responseRecorder records the status code of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the connection cannot be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// code returns the status code label of the response
+func (r *responseRecorder) code() string {
+	switch {
+	case r.hijacked:
+		return "hijacked"
+	case r.status == 0:
+		return strconv.Itoa(http.StatusOK)
+	}
+	return strconv.Itoa(r.status)
+}
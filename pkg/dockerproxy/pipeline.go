@@ -0,0 +1,171 @@
+package dockerproxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// Route identifies a Docker API operation that interceptors can register for
+type Route string
+
+const (
+	RouteContainerCreate  Route = "create"
+	RouteContainerStart   Route = "start"
+	RouteContainerUpdate  Route = "update"
+	RouteContainerInspect Route = "inspect"
+	RouteExecCreate       Route = "exec"
+	RouteExecStart        Route = "exec-start"
+	RouteBuild            Route = "build"
+	RouteImagePull        Route = "pull"
+)
+
+// BeforeFunc is called with a request before it is sent to the daemon. It
+// returns the request to send instead, which should keep the context of req.
+// To answer the request itself without sending it to the daemon, it returns a
+// response. If it returns an error, the error is returned to the client.
+type BeforeFunc func(req *http.Request) (*http.Request, *http.Response, error)
+
+// ModifyRequest returns a BeforeFunc that modifies requests with fn
+func ModifyRequest(fn RequestModifierFunc) BeforeFunc {
+	return func(req *http.Request) (*http.Request, *http.Response, error) {
+		newReq, err := fn(req)
+		return newReq, nil, err
+	}
+}
+
+// Interceptor hooks into the requests of the routes it registers for. Either
+// hook may be nil.
+type Interceptor struct {
+	// Name identifies the interceptor in logs
+	Name string
+	// Routes are the routes the interceptor applies to. It applies to every
+	// request if there are none.
+	Routes []Route
+	// Before is called before the request is sent to the daemon, including
+	// for connection upgrades
+	Before BeforeFunc
+	// After is called with the response before it is returned to the client.
+	// It is not called for connection upgrades, such as attach sessions.
+	After ResponseModifierFunc
+}
+
+func (i *Interceptor) applies(route Route) bool {
+	if len(i.Routes) == 0 {
+		return true
+	}
+	for _, r := range i.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline is an ordered list of interceptors. The Before hooks of the
+// interceptors that apply to a request are called in the order the
+// interceptors were added, and their After hooks in the reverse order, so
+// that the first interceptor sees the request first and the response last.
+//
+// When a Before hook answers a request itself, the remaining Before hooks are
+// skipped and the request is not sent to the daemon. The response goes through
+// the After hooks of the interceptors whose Before hooks were called before it.
+type Pipeline struct {
+	interceptors []Interceptor
+}
+
+// NewPipeline returns a pipeline of the given interceptors, in order
+func NewPipeline(interceptors ...Interceptor) *Pipeline {
+	p := &Pipeline{}
+	for _, i := range interceptors {
+		p.Add(i)
+	}
+	return p
+}
+
+// Add appends an interceptor to the pipeline. Interceptors must all be added
+// before the pipeline is used.
+func (p *Pipeline) Add(i Interceptor) {
+	p.interceptors = append(p.interceptors, i)
+}
+
+// requestState is the progress of a request through the pipeline. It is kept
+// in the context of the request.
+type requestState struct {
+	// original is the request as the client sent it
+	original *http.Request
+	// route is the route of the request, with its API version
+	route RouteMatch
+	// called holds the interceptors whose Before hooks have been called, or
+	// which apply to the request if they have no Before hook
+	called []*Interceptor
+}
+
+type requestStateKey struct{}
+
+// before calls the Before hooks of the interceptors that apply to the request.
+// It returns the request to send to the daemon, or a response if an
+// interceptor answered the request.
+func (p *Pipeline) before(state *requestState, req *http.Request) (*http.Request, *http.Response, error) {
+	route := state.route.Route
+	for i := range p.interceptors {
+		interceptor := &p.interceptors[i]
+		if !interceptor.applies(route) {
+			continue
+		}
+		if interceptor.Before == nil {
+			state.called = append(state.called, interceptor)
+			continue
+		}
+		newReq, resp, err := interceptor.Before(req)
+		if err != nil {
+			glog.Infof("Interceptor %s failed on %s %s: %v", interceptor.Name, req.Method, req.URL.Path, err)
+			return nil, nil, err
+		}
+		if resp != nil {
+			glog.V(2).Infof("Interceptor %s answered %s %s", interceptor.Name, req.Method, req.URL.Path)
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			return nil, resp, nil
+		}
+		state.called = append(state.called, interceptor)
+		if newReq != nil {
+			req = newReq
+		}
+	}
+	return req, nil, nil
+}
+
+// after calls the After hooks of the interceptors that were called before the
+// request was sent, in reverse order
+func (p *Pipeline) after(state *requestState, resp *http.Response) error {
+	for i := len(state.called) - 1; i >= 0; i-- {
+		interceptor := state.called[i]
+		if interceptor.After == nil {
+			continue
+		}
+		if err := interceptor.After(resp, state.original); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResponse sends a response created by an interceptor to the client
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body == nil {
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		glog.Errorf("Error writing response: %v", err)
+	}
+}
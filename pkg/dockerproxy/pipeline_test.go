@@ -0,0 +1,169 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// Behaviours of the hooks of a test interceptor
+const (
+	hookPass   = "pass"
+	hookAnswer = "answer"
+	hookFail   = "fail"
+)
+
+// testInterceptor describes an interceptor that records its calls. An empty
+// before or after means the interceptor has no such hook.
+type testInterceptor struct {
+	name   string
+	routes []Route
+	before string
+	after  string
+}
+
+func (ti testInterceptor) interceptor(calls *[]string) Interceptor {
+	i := Interceptor{Name: ti.name, Routes: ti.routes}
+	if len(ti.before) > 0 {
+		i.Before = func(req *http.Request) (*http.Request, *http.Response, error) {
+			*calls = append(*calls, ti.name+".before")
+			switch ti.before {
+			case hookAnswer:
+				return nil, &http.Response{StatusCode: http.StatusNoContent}, nil
+			case hookFail:
+				return nil, nil, BadRequest("%s failed", ti.name)
+			}
+			// Later interceptors see the request returned by earlier ones
+			newReq := req.WithContext(req.Context())
+			newReq.Header = http.Header{"Seen-By": append(req.Header["Seen-By"], ti.name)}
+			return newReq, nil, nil
+		}
+	}
+	if len(ti.after) > 0 {
+		i.After = func(resp *http.Response, req *http.Request) error {
+			*calls = append(*calls, ti.name+".after")
+			if ti.after == hookFail {
+				return fmt.Errorf("%s failed", ti.name)
+			}
+			return nil
+		}
+	}
+	return i
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name         string
+		interceptors []testInterceptor
+		route        Route
+		// calls are the hooks called, in order
+		calls []string
+		// seenBy are the interceptors whose Before hooks modified the request
+		// before it was sent to the daemon or answered
+		seenBy   []string
+		answered bool
+		err      bool
+	}{
+		{
+			name: "order",
+			interceptors: []testInterceptor{
+				{name: "a", before: hookPass, after: hookPass},
+				{name: "b", before: hookPass, after: hookPass},
+				{name: "c", before: hookPass, after: hookPass},
+			},
+			route:  RouteContainerCreate,
+			calls:  []string{"a.before", "b.before", "c.before", "c.after", "b.after", "a.after"},
+			seenBy: []string{"a", "b", "c"},
+		},
+		{
+			name: "routes",
+			interceptors: []testInterceptor{
+				{name: "create", routes: []Route{RouteContainerCreate}, before: hookPass, after: hookPass},
+				{name: "pull", routes: []Route{RouteImagePull, RouteBuild}, before: hookPass, after: hookPass},
+				{name: "all", before: hookPass, after: hookPass},
+			},
+			route:  RouteImagePull,
+			calls:  []string{"pull.before", "all.before", "all.after", "pull.after"},
+			seenBy: []string{"pull", "all"},
+		},
+		{
+			name: "missing hooks",
+			interceptors: []testInterceptor{
+				{name: "a", after: hookPass},
+				{name: "b", before: hookPass},
+			},
+			route:  RouteContainerCreate,
+			calls:  []string{"b.before", "a.after"},
+			seenBy: []string{"b"},
+		},
+		{
+			name: "answered by a before hook",
+			interceptors: []testInterceptor{
+				{name: "a", before: hookPass, after: hookPass},
+				{name: "b", before: hookAnswer, after: hookPass},
+				{name: "c", before: hookPass, after: hookPass},
+			},
+			route:    RouteContainerCreate,
+			calls:    []string{"a.before", "b.before", "a.after"},
+			seenBy:   []string{"a"},
+			answered: true,
+		},
+		{
+			name: "before hook error",
+			interceptors: []testInterceptor{
+				{name: "a", before: hookPass, after: hookPass},
+				{name: "b", before: hookFail, after: hookPass},
+				{name: "c", before: hookPass, after: hookPass},
+			},
+			route: RouteContainerCreate,
+			calls: []string{"a.before", "b.before"},
+			err:   true,
+		},
+		{
+			name: "after hook error",
+			interceptors: []testInterceptor{
+				{name: "a", before: hookPass, after: hookPass},
+				{name: "b", before: hookPass, after: hookFail},
+				{name: "c", before: hookPass, after: hookPass},
+			},
+			route:  RouteContainerCreate,
+			calls:  []string{"a.before", "b.before", "c.before", "c.after", "b.after"},
+			seenBy: []string{"a", "b", "c"},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		var calls []string
+		p := NewPipeline()
+		for _, ti := range test.interceptors {
+			p.Add(ti.interceptor(&calls))
+		}
+		req, err := http.NewRequest("POST", "http://docker/v1.24/containers/create", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := &requestState{original: req, route: RouteMatch{Route: test.route}}
+
+		proxied, resp, err := p.before(state, req)
+		if err == nil {
+			if (resp != nil) != test.answered {
+				t.Errorf("%s: expected answered %t, got response %v", test.name, test.answered, resp)
+				continue
+			}
+			if resp == nil {
+				resp = &http.Response{StatusCode: http.StatusCreated, Request: proxied}
+			}
+			if seenBy := resp.Request.Header["Seen-By"]; !reflect.DeepEqual(seenBy, test.seenBy) {
+				t.Errorf("%s: expected the request of %v, got the request of %v", test.name, test.seenBy, seenBy)
+			}
+			err = p.after(state, resp)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: expected calls %v, got %v", test.name, test.calls, calls)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package dockerproxy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,12 +23,25 @@ const (
 	HeaderUpgrade    = "Upgrade"
 )
 
+// RequestModifierFunc is called with a request before it is sent to the
+// daemon, and returns the request to send instead. The returned request should
+// keep the context of req. If it returns an error, the error is returned to
+// the client instead.
 type RequestModifierFunc func(req *http.Request) (*http.Request, error)
 
+// ResponseModifierFunc is called with a response of the daemon before it is
+// returned to the client. req is the request as the client sent it, before any
+// interceptor changed it; resp.Request is the request that was sent to the
+// daemon. The response can be modified in place. If it returns an error, the
+// error is returned to the client instead of the response.
+type ResponseModifierFunc func(resp *http.Response, req *http.Request) error
+
 type dockerProxy struct {
-	dockerHost      string
-	requestModifier RequestModifierFunc
-	internalProxy   *httputil.ReverseProxy
+	backend       *Backend
+	pipeline      *Pipeline
+	versions      *versionCache
+	internalProxy *httputil.ReverseProxy
+	metrics       *Metrics
 }
 
 type connCloser interface {
@@ -32,6 +49,10 @@ type connCloser interface {
 	CloseWrite() error
 }
 
+type writeCloser interface {
+	CloseWrite() error
+}
+
 var fakeDockerURL = mustParse("http://dockerhost")
 
 func mustParse(str string) *url.URL {
@@ -42,44 +63,114 @@ func mustParse(str string) *url.URL {
 	return u
 }
 
-func New(requestModifierFn RequestModifierFunc) http.Handler {
+// New returns a handler that proxies requests to the Docker daemon reached
+// through the given backend, passing them through the interceptors of the
+// pipeline. Requests are recorded in metrics if it is not nil.
+func New(backend *Backend, pipeline *Pipeline, metrics *Metrics) http.Handler {
+	if pipeline == nil {
+		pipeline = NewPipeline()
+	}
+	p := &dockerProxy{
+		backend:  backend,
+		pipeline: pipeline,
+		versions: &versionCache{backend: backend},
+		metrics:  metrics,
+	}
 	internalProxy := httputil.NewSingleHostReverseProxy(fakeDockerURL)
 	internalProxy.FlushInterval = 500 * time.Millisecond
-	internalProxy.Transport = &http.Transport{
-		Dial: dialDockerWrapper,
+	internalProxy.Transport = backend.Transport()
+	internalProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		glog.Errorf("Error proxying %s %s: %v", req.Method, req.URL.String(), err)
+		WriteError(w, fmt.Errorf("error communicating with the Docker daemon: %v", err), http.StatusBadGateway)
 	}
-	return &dockerProxy{
-		requestModifier: requestModifierFn,
-		internalProxy:   internalProxy,
+	internalProxy.ModifyResponse = p.modifyResponse
+	p.internalProxy = internalProxy
+	return p
+}
+
+func (p *dockerProxy) modifyResponse(resp *http.Response) error {
+	state, ok := resp.Request.Context().Value(requestStateKey{}).(*requestState)
+	if !ok {
+		return nil
 	}
+	return p.pipeline.after(state, resp)
+}
+
+// SetResponseBody replaces the body of a response, updating its length
+func SetResponseBody(resp *http.Response, body []byte) {
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
 }
 
 // ServeHTTP handles the proxy request
-func (p *dockerProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (p *dockerProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	glog.Infof("Serving %s %s\n", req.Method, req.URL.String())
-	upgraded, err := p.tryUpgrade(w, req)
+	w := &responseRecorder{ResponseWriter: rw}
+	start := time.Now()
+	defer func() {
+		p.metrics.observeRequest(req, w.code(), start, w.hijacked)
+	}()
+	state := &requestState{route: p.route(req)}
+	req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+	state.original = req
+	proxied, resp, err := p.pipeline.before(state, req)
+	if err != nil {
+		p.metrics.modifierFailed(req)
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if resp != nil {
+		p.respond(w, state, resp)
+		return
+	}
+	upgraded, hijacked, err := p.tryUpgrade(w, proxied)
 	if err != nil {
 		glog.Errorf("error occurred on upgrade: %v", err)
+		if !hijacked {
+			WriteError(w, err, http.StatusBadGateway)
+		}
 	}
 	if upgraded {
 		return
 	}
-	if p.requestModifier != nil {
-		req, err = p.requestModifier(req)
+	p.internalProxy.ServeHTTP(w, proxied)
+}
+
+// route routes a request, taking the API version of requests without one
+// from the daemon
+func (p *dockerProxy) route(req *http.Request) RouteMatch {
+	route := MatchRoute(req.Method, req.URL.Path)
+	// The daemon is only asked for routes that interceptors may register
+	// for, so that it is not queried for unknown requests while it is down
+	if !route.Versioned && len(route.Route) > 0 {
+		version, err := p.versions.get()
 		if err != nil {
-			glog.Infof("Error modifying request: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			glog.Warningf("Cannot determine the API version of %s %s: %v", req.Method, req.URL.Path, err)
 		}
+		route.Version = version
 	}
-	p.internalProxy.ServeHTTP(w, req)
+	return route
 }
 
-func (p *dockerProxy) writeError(w http.ResponseWriter, err error) {
-	msg := "internal error"
-	if err != nil {
-		msg = err.Error()
+// respond returns a response created by an interceptor to the client, after
+// passing it through the After hooks of the interceptors called before it
+func (p *dockerProxy) respond(w http.ResponseWriter, state *requestState, resp *http.Response) {
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	if err := p.pipeline.after(state, resp); err != nil {
+		glog.Errorf("Error modifying response to %s %s: %v", state.original.Method, state.original.URL.String(), err)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		WriteError(w, err, http.StatusInternalServerError)
+		return
 	}
-	http.Error(w, msg, http.StatusInternalServerError)
+	writeResponse(w, resp)
 }
 
 // IsUpgradeRequest returns true if the given request is a connection upgrade request
@@ -98,34 +189,45 @@ func (p *dockerProxy) dockerURL(req *http.Request) string {
 	return u.String()
 }
 
-func dialDockerWrapper(string, string) (net.Conn, error) {
-	return dialDocker()
+// closeRead shuts down the reading side of a connection if the connection
+// supports it. TLS connections cannot be half closed for reading, so nothing
+// is done for them; they get fully closed once both copies are done.
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(connCloser); ok {
+		c.CloseRead()
+	}
 }
 
-func dialDocker() (net.Conn, error) {
-	return net.Dial("unix", "/var/run/docker.sock")
+// closeWrite shuts down the writing side of a connection, falling back to
+// closing it entirely when half close is not supported.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(writeCloser); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
 }
 
-func (p *dockerProxy) tryUpgrade(w http.ResponseWriter, req *http.Request) (bool, error) {
+// tryUpgrade proxies a connection upgrade request by hijacking the client
+// connection and copying data in both directions. It returns whether the
+// request was an upgrade request and whether the client connection was
+// hijacked, in which case no response can be written to it anymore.
+func (p *dockerProxy) tryUpgrade(w http.ResponseWriter, req *http.Request) (bool, bool, error) {
 	if !isUpgradeRequest(req) {
-		return false, nil
+		return false, false, nil
 	}
-	backendConn, err := dialDocker()
+	backendConn, err := p.backend.Dial()
 	if err != nil {
-		return true, err
+		return true, false, fmt.Errorf("cannot connect to the Docker daemon: %v", err)
 	}
-	backendCloser, ok := backendConn.(connCloser)
-	if !ok {
-		return true, fmt.Errorf("backend connection is not connection closer")
-	}
-	requestHijackedConn, _, err := w.(http.Hijacker).Hijack()
+	defer backendConn.Close()
+	requestHijackedConn, clientBuf, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		return true, err
-	}
-	requestCloser, ok := requestHijackedConn.(connCloser)
-	if !ok {
-		return true, fmt.Errorf("request connection is not connection closer")
+		return true, false, err
 	}
+	defer requestHijackedConn.Close()
+	p.metrics.hijackStarted()
+	defer p.metrics.hijackEnded()
 
 	/*
 		newRequest, err := http.NewRequest(req.Method, p.dockerURL(req), req.Body)
@@ -136,32 +238,36 @@ func (p *dockerProxy) tryUpgrade(w http.ResponseWriter, req *http.Request) (bool
 	*/
 
 	if err = req.Write(backendConn); err != nil {
-		return true, fmt.Errorf("error writing request to backend: %v", err)
+		return true, true, fmt.Errorf("error writing request to backend: %v", err)
 	}
 
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
-		_, err := io.Copy(backendConn, requestHijackedConn)
+		// Read through the buffer of the hijacked connection, which may
+		// already hold data the client sent after the request
+		n, err := io.Copy(backendConn, clientBuf.Reader)
+		p.metrics.copied("client_to_daemon", n)
 		if err != nil {
 			glog.Errorf("Error copying data from client to backend: %v", err)
 		}
 		wg.Done()
-		backendCloser.CloseWrite()
-		requestCloser.CloseRead()
+		closeWrite(backendConn)
+		closeRead(requestHijackedConn)
 	}()
 
 	go func() {
-		_, err := io.Copy(requestHijackedConn, backendConn)
+		n, err := io.Copy(requestHijackedConn, backendConn)
+		p.metrics.copied("daemon_to_client", n)
 		if err != nil {
 			glog.Errorf("Error copying data from backend to client: %v", err)
 		}
 		wg.Done()
-		requestCloser.CloseWrite()
-		backendCloser.CloseRead()
+		closeWrite(requestHijackedConn)
+		closeRead(backendConn)
 	}()
 
 	wg.Wait()
-	return true, nil
+	return true, true, nil
 }
@@ -0,0 +1,307 @@
+package dockerproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// APIVersion is a Docker API version, such as 1.24. The zero value is an
+// unknown version.
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+var apiVersionPattern = regexp.MustCompile(`^v?([0-9]+)\.([0-9]+)$`)
+
+// versionSegment matches the first segment of paths with a version prefix,
+// whether or not the version is well formed
+var versionSegment = regexp.MustCompile(`^v[0-9.]+$`)
+
+// ParseAPIVersion parses a Docker API version such as 1.24 or v1.24
+func ParseAPIVersion(s string) (APIVersion, error) {
+	m := apiVersionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return APIVersion{}, fmt.Errorf("invalid API version %q, expected MAJOR.MINOR", s)
+	}
+	major, err := strconv.Atoi(m[1])
+	if err != nil {
+		return APIVersion{}, fmt.Errorf("invalid API version %q: %v", s, err)
+	}
+	minor, err := strconv.Atoi(m[2])
+	if err != nil {
+		return APIVersion{}, fmt.Errorf("invalid API version %q: %v", s, err)
+	}
+	return APIVersion{Major: major, Minor: minor}, nil
+}
+
+// IsZero returns whether the version is unknown
+func (v APIVersion) IsZero() bool {
+	return v == APIVersion{}
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or greater than o
+func (v APIVersion) Compare(o APIVersion) int {
+	switch {
+	case v.Major != o.Major:
+		if v.Major < o.Major {
+			return -1
+		}
+		return 1
+	case v.Minor != o.Minor:
+		if v.Minor < o.Minor {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func (v APIVersion) String() string {
+	if v.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// routeTemplate is a method and path of the Docker API, without the version
+// prefix. A {name} segment matches the name or ID of an object.
+type routeTemplate struct {
+	method string
+	path   []string
+	route  Route
+}
+
+var routeTemplates = compileRouteTemplates(map[string]Route{
+	"POST /containers/create":        RouteContainerCreate,
+	"POST /containers/{name}/start":  RouteContainerStart,
+	"POST /containers/{name}/update": RouteContainerUpdate,
+	"GET /containers/{name}/json":    RouteContainerInspect,
+	"POST /containers/{name}/exec":   RouteExecCreate,
+	"POST /exec/{name}/start":        RouteExecStart,
+	"POST /build":                    RouteBuild,
+	"POST /images/create":            RouteImagePull,
+})
+
+func compileRouteTemplates(routes map[string]Route) []routeTemplate {
+	var templates []routeTemplate
+	for spec, route := range routes {
+		parts := strings.SplitN(spec, " ", 2)
+		templates = append(templates, routeTemplate{
+			method: parts[0],
+			path:   strings.Split(strings.Trim(parts[1], "/"), "/"),
+			route:  route,
+		})
+	}
+	return templates
+}
+
+func (t *routeTemplate) match(method string, path []string) (string, bool) {
+	if method != t.method || len(path) != len(t.path) {
+		return "", false
+	}
+	var name string
+	for i, segment := range t.path {
+		switch {
+		case segment == "{name}" && len(path[i]) > 0:
+			name = path[i]
+		case segment != path[i]:
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// EndpointOther is the endpoint of requests whose path is not part of the
+// Docker API
+const EndpointOther = "other"
+
+// endpoints are the paths of the Docker API, without the version prefix, used
+// to group requests in metrics. A {name} segment matches the name or ID of an
+// object, which for images may contain slashes.
+var endpoints = compileEndpoints(
+	"/_ping", "/auth", "/build", "/build/prune", "/commit", "/events", "/info",
+	"/session", "/system/df", "/version",
+	"/containers/json", "/containers/create", "/containers/prune",
+	"/containers/{name}", "/containers/{name}/archive", "/containers/{name}/attach",
+	"/containers/{name}/attach/ws", "/containers/{name}/changes", "/containers/{name}/exec",
+	"/containers/{name}/export", "/containers/{name}/json", "/containers/{name}/kill",
+	"/containers/{name}/logs", "/containers/{name}/pause", "/containers/{name}/rename",
+	"/containers/{name}/resize", "/containers/{name}/restart", "/containers/{name}/start",
+	"/containers/{name}/stats", "/containers/{name}/stop", "/containers/{name}/top",
+	"/containers/{name}/unpause", "/containers/{name}/update", "/containers/{name}/wait",
+	"/exec/{name}/json", "/exec/{name}/resize", "/exec/{name}/start",
+	"/images/json", "/images/create", "/images/get", "/images/load", "/images/prune",
+	"/images/search", "/images/{name}", "/images/{name}/get", "/images/{name}/history",
+	"/images/{name}/json", "/images/{name}/push", "/images/{name}/tag",
+	"/distribution/{name}/json",
+	"/networks", "/networks/create", "/networks/prune", "/networks/{name}",
+	"/networks/{name}/connect", "/networks/{name}/disconnect",
+	"/volumes", "/volumes/create", "/volumes/prune", "/volumes/{name}",
+	"/plugins", "/plugins/create", "/plugins/privileges", "/plugins/pull",
+	"/plugins/{name}", "/plugins/{name}/disable", "/plugins/{name}/enable",
+	"/plugins/{name}/json", "/plugins/{name}/push", "/plugins/{name}/set",
+	"/plugins/{name}/upgrade",
+	"/swarm", "/swarm/init", "/swarm/join", "/swarm/leave", "/swarm/unlock",
+	"/swarm/unlockkey", "/swarm/update",
+	"/nodes", "/nodes/{name}", "/nodes/{name}/update",
+	"/services", "/services/create", "/services/{name}", "/services/{name}/logs",
+	"/services/{name}/update",
+	"/tasks", "/tasks/{name}", "/tasks/{name}/logs",
+	"/secrets", "/secrets/create", "/secrets/{name}", "/secrets/{name}/update",
+	"/configs", "/configs/create", "/configs/{name}", "/configs/{name}/update",
+)
+
+// compileEndpoints splits endpoint paths into segments. Paths that do not name
+// an object come first, so that /images/create is not taken for an image named
+// create, and the other paths are ordered from the longest, so that
+// /containers/{name}/start is not taken for a container named {name}/start.
+func compileEndpoints(paths ...string) [][]string {
+	var fixed, named [][]string
+	for _, path := range paths {
+		segments := strings.Split(strings.Trim(path, "/"), "/")
+		if strings.Contains(path, "{name}") {
+			named = append(named, segments)
+		} else {
+			fixed = append(fixed, segments)
+		}
+	}
+	sort.SliceStable(named, func(i, j int) bool { return len(named[i]) > len(named[j]) })
+	return append(fixed, named...)
+}
+
+// matchEndpoint matches path segments against the segments of an endpoint,
+// where {name} matches one or more segments
+func matchEndpoint(endpoint, path []string) bool {
+	for i, segment := range endpoint {
+		if segment != "{name}" {
+			if i >= len(path) || path[i] != segment {
+				return false
+			}
+			continue
+		}
+		rest := endpoint[i+1:]
+		n := len(path) - i - len(rest)
+		if n < 1 || len(strings.Join(path[i:i+n], "")) == 0 {
+			return false
+		}
+		for j := range rest {
+			if path[i+n+j] != rest[j] {
+				return false
+			}
+		}
+		return true
+	}
+	return len(path) == len(endpoint)
+}
+
+// RouteMatch is the result of routing a request of the Docker API
+type RouteMatch struct {
+	// Route is the route of the request, or empty if it is not one of the
+	// known routes
+	Route Route
+	// Name is the name or ID of the object in the path, if any
+	Name string
+	// Version is the API version the daemon handles the request with: the
+	// version in the path or, for requests without one, the default version
+	// of the daemon. It is zero if it is not known.
+	Version APIVersion
+	// Versioned is set if the path had a version prefix
+	Versioned bool
+	// Endpoint is the Docker API endpoint of the path, without the version
+	// and with object names replaced by {name}, such as
+	// /containers/{name}/start. It is EndpointOther for paths that are not
+	// part of the Docker API, so that it can be used to group requests.
+	Endpoint string
+}
+
+// MatchRoute routes a request by its method and path. Paths may start with a
+// /vMAJOR.MINOR version prefix; anything else before the route, or a
+// malformed version, does not match.
+func MatchRoute(method, path string) RouteMatch {
+	result := RouteMatch{Endpoint: EndpointOther}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 1 && versionSegment.MatchString(segments[0]) {
+		version, err := ParseAPIVersion(segments[0])
+		if err != nil {
+			return result
+		}
+		result.Version, result.Versioned = version, true
+		segments = segments[1:]
+	}
+	for i := range routeTemplates {
+		if name, ok := routeTemplates[i].match(method, segments); ok {
+			result.Route, result.Name = routeTemplates[i].route, name
+			break
+		}
+	}
+	for _, endpoint := range endpoints {
+		if matchEndpoint(endpoint, segments) {
+			result.Endpoint = "/" + strings.Join(endpoint, "/")
+			break
+		}
+	}
+	return result
+}
+
+// RouteOf returns the route of a request as matched by the proxy, or routes
+// it if it did not go through the proxy
+func RouteOf(req *http.Request) RouteMatch {
+	if state, ok := req.Context().Value(requestStateKey{}).(*requestState); ok {
+		return state.route
+	}
+	return MatchRoute(req.Method, req.URL.Path)
+}
+
+// versionCache remembers the default API version of the daemon
+type versionCache struct {
+	backend *Backend
+	lock    sync.Mutex
+	version APIVersion
+	// lookup is the lookup in progress, if any. Requests that arrive while
+	// it runs wait for its result instead of asking the daemon again.
+	lookup *versionLookup
+}
+
+type versionLookup struct {
+	// done is closed when the lookup completes
+	done    chan struct{}
+	version APIVersion
+	err     error
+}
+
+// get returns the default API version of the daemon. It is looked up until
+// the daemon answers, and then remembered. The lock is not held while the
+// daemon is asked, so that a daemon that does not answer only delays the
+// requests that need its version.
+func (c *versionCache) get() (APIVersion, error) {
+	c.lock.Lock()
+	if !c.version.IsZero() {
+		defer c.lock.Unlock()
+		return c.version, nil
+	}
+	lookup := c.lookup
+	if lookup != nil {
+		c.lock.Unlock()
+		<-lookup.done
+		return lookup.version, lookup.err
+	}
+	lookup = &versionLookup{done: make(chan struct{})}
+	c.lookup = lookup
+	c.lock.Unlock()
+
+	lookup.version, lookup.err = c.backend.APIVersion()
+	c.lock.Lock()
+	if lookup.err == nil {
+		c.version = lookup.version
+	}
+	c.lookup = nil
+	c.lock.Unlock()
+	close(lookup.done)
+	return lookup.version, lookup.err
+}
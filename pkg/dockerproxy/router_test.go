@@ -0,0 +1,58 @@
+package dockerproxy
+
+import (
+	"testing"
+)
+
+func TestMatchRoute(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		expected RouteMatch
+	}{
+		{"POST", "/v1.24/containers/create", RouteMatch{Route: RouteContainerCreate, Version: APIVersion{1, 24}, Versioned: true, Endpoint: "/containers/create"}},
+		{"POST", "/containers/create", RouteMatch{Route: RouteContainerCreate, Endpoint: "/containers/create"}},
+		{"POST", "/v1.41/containers/create/", RouteMatch{Route: RouteContainerCreate, Version: APIVersion{1, 41}, Versioned: true, Endpoint: "/containers/create"}},
+		{"POST", "/v1.24/containers/abc/start", RouteMatch{Route: RouteContainerStart, Name: "abc", Version: APIVersion{1, 24}, Versioned: true, Endpoint: "/containers/{name}/start"}},
+		{"GET", "/containers/web/json", RouteMatch{Route: RouteContainerInspect, Name: "web", Endpoint: "/containers/{name}/json"}},
+		{"POST", "/v1.24/containers/abc/update", RouteMatch{Route: RouteContainerUpdate, Name: "abc", Version: APIVersion{1, 24}, Versioned: true, Endpoint: "/containers/{name}/update"}},
+		{"POST", "/containers/abc/exec", RouteMatch{Route: RouteExecCreate, Name: "abc", Endpoint: "/containers/{name}/exec"}},
+		{"POST", "/exec/123/start", RouteMatch{Route: RouteExecStart, Name: "123", Endpoint: "/exec/{name}/start"}},
+		{"POST", "/v1.39/build", RouteMatch{Route: RouteBuild, Version: APIVersion{1, 39}, Versioned: true, Endpoint: "/build"}},
+		{"POST", "/images/create", RouteMatch{Route: RouteImagePull, Endpoint: "/images/create"}},
+
+		// Known endpoints that are not routed
+		{"GET", "/containers/create", RouteMatch{Endpoint: "/containers/create"}},
+		{"GET", "/v1.24/containers/json", RouteMatch{Version: APIVersion{1, 24}, Versioned: true, Endpoint: "/containers/json"}},
+		{"DELETE", "/containers/abc", RouteMatch{Endpoint: "/containers/{name}"}},
+		{"GET", "/images/openshift/origin/json", RouteMatch{Endpoint: "/images/{name}/json"}},
+		{"GET", "/images/registry.local:5000/origin", RouteMatch{Endpoint: "/images/{name}"}},
+		{"GET", "/_ping", RouteMatch{Endpoint: "/_ping"}},
+		{"GET", "/v1.24/version", RouteMatch{Version: APIVersion{1, 24}, Versioned: true, Endpoint: "/version"}},
+		// A version alone is not a path of the API
+		{"GET", "/v1.24", RouteMatch{Endpoint: EndpointOther}},
+
+		// Anything before the route other than a version does not match
+		{"POST", "/foo/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/v1.24/v1.24/containers/create", RouteMatch{Version: APIVersion{1, 24}, Versioned: true, Endpoint: EndpointOther}},
+		{"POST", "/api/v1.24/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/1.24/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/vx/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		// Malformed versions do not match
+		{"POST", "/v1/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/v1.2.3/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/v.24/containers/create", RouteMatch{Endpoint: EndpointOther}},
+		// Nor does anything after the route, which the daemon takes as part of
+		// an object name when the path has one, since names may hold slashes
+		{"POST", "/build/extra", RouteMatch{Endpoint: EndpointOther}},
+		{"POST", "/containers/create/extra", RouteMatch{Endpoint: "/containers/{name}"}},
+		{"POST", "/containers/abc/start/extra", RouteMatch{Endpoint: "/containers/{name}"}},
+		{"GET", "/", RouteMatch{Endpoint: EndpointOther}},
+		{"GET", "", RouteMatch{Endpoint: EndpointOther}},
+	}
+	for _, test := range tests {
+		if actual := MatchRoute(test.method, test.path); actual != test.expected {
+			t.Errorf("%s %q: expected %+v, got %+v", test.method, test.path, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package filewatch notifies when files change on disk
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// settleDelay is how long to wait after a change before notifying, so that
+// an editor writing a file in several steps results in a single notification
+const settleDelay = 200 * time.Millisecond
+
+// kubernetesDataDir is the symlink swapped when a mounted config map is updated
+const kubernetesDataDir = "..data"
+
+// Watcher calls a function whenever one of a set of files is written,
+// replaced or removed. Watches are set on the parent directories so that files
+// replaced through a rename (as editors and Kubernetes config maps do) are
+// still seen. If one of the paths is a directory, any file added, changed or
+// removed in it counts as a change.
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	events  chan struct{}
+
+	lock sync.Mutex
+	// files are the watched files
+	files map[string]bool
+	// dirs are the directories that contain watched files, or are watched
+	// themselves
+	dirs map[string]bool
+	// trees are the watched directories, where a change to any entry counts
+	trees map[string]bool
+}
+
+// New returns a watcher that calls changed from a separate goroutine until
+// the watcher is closed. It watches nothing until Set is called.
+func New(changed func()) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		watcher: watcher,
+		events:  make(chan struct{}, 1),
+		files:   map[string]bool{},
+		dirs:    map[string]bool{},
+		trees:   map[string]bool{},
+	}
+	go w.readEvents()
+	go debounce(w.events, changed)
+	return w, nil
+}
+
+// Set replaces the watched paths. Directories that no longer hold a watched
+// path stop being watched, and a directory is only watched once however many
+// of the paths are in it.
+func (w *Watcher) Set(paths []string) error {
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	trees := map[string]bool{}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			dirs[abs] = true
+			trees[abs] = true
+			continue
+		}
+		files[abs] = true
+		dirs[filepath.Dir(abs)] = true
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			return fmt.Errorf("cannot watch %s: %v", dir, err)
+		}
+		w.dirs[dir] = true
+	}
+	for dir := range w.dirs {
+		if dirs[dir] {
+			continue
+		}
+		// The directory may have been removed, which removes its watch
+		if err := w.watcher.Remove(dir); err != nil {
+			glog.V(4).Infof("Cannot stop watching %s: %v", dir, err)
+		}
+		delete(w.dirs, dir)
+	}
+	w.files = files
+	w.trees = trees
+	return nil
+}
+
+// Close stops watching and calling the changed function
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+// matches returns whether a change to the named file is a change to the
+// watched paths
+func (w *Watcher) matches(path string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	dir := filepath.Dir(path)
+	if !w.dirs[dir] {
+		return false
+	}
+	return filepath.Base(path) == kubernetesDataDir || w.trees[dir] || w.files[path]
+}
+
+func (w *Watcher) readEvents() {
+	defer close(w.events)
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.matches(event.Name) {
+				notify(w.events)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if err == fsnotify.ErrEventOverflow {
+				// Changes to the watched files may have been dropped
+				notify(w.events)
+				continue
+			}
+			glog.Errorf("Error watching files: %v", err)
+		}
+	}
+}
+
+func debounce(events <-chan struct{}, changed func()) {
+	for range events {
+		timer := time.NewTimer(settleDelay)
+	settle:
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					timer.Stop()
+					return
+				}
+				timer.Reset(settleDelay)
+			case <-timer.C:
+				break settle
+			}
+		}
+		changed()
+	}
+}
+
+// notify records a pending change without blocking the watcher
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}